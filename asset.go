@@ -18,6 +18,9 @@ Asset functions
 - rollbackTransaction
 - verifyHoldings
 - verifyPrice
+- applyUpdate
+- needsApproval
+- canApprove
 
 */
 
@@ -27,7 +30,6 @@ package main
 
 import (
     "encoding/json"
-    "errors"
     "strconv"
     "time"
     "strings"
@@ -60,6 +62,8 @@ type Asset struct {
     //
     Triggers    Trigger                 `json:"triggers"`
     Contract    API                     `json:"apiTrigger"`
+    //
+    Version     int                     `json:"version"` // Increased on every update, to detect conflicting edits.
 }
 
 
@@ -94,6 +98,10 @@ type API struct {
 }
 
 
+// Fields that can be changed with updateAsset.
+var ASSETUPDATEFIELDS = []string{ "name", "description", "logo", "tag", "approval", "approvalQty", "url", "keys", "condition", "value", "discount" }
+
+
 // ============================================================================================================================
 
 
@@ -104,7 +112,7 @@ func (a *Asset) save(stub shim.ChaincodeStubInterface) (error) {
         utils.PrintErrorFull("save - Marshal", err)
         return err
     }
-    if err = stub.PutState(a.Id, assetBytesToWrite); err != nil {
+    if err = stub.PutState(assetKey(a.Id), assetBytesToWrite); err != nil {
         utils.PrintErrorFull("save - PutState", err)
         return err
     }
@@ -171,7 +179,7 @@ func (a *Asset) escrowOwner(ownerId string, quantity int) {
 
 
 func (a *Asset) rollbackTransaction(ownerId string, quantity int) {
-    a.escrowOwner(ownerId, quantity) // We can call it with a negative number
+    a.escrowOwner(ownerId, -quantity) // Moves the quantity back out of escrow
     // Also update the Quantity available if the owner is the issuer.
     if ownerId == a.Issuer {
         a.Quantity = a.Quantity + quantity
@@ -179,26 +187,90 @@ func (a *Asset) rollbackTransaction(ownerId string, quantity int) {
 } // end of a.rollbackTransaction
 
 
-func (a *Asset) verifyHoldings(ownerId string, quantity int) (error) {
+func (a *Asset) verifyHoldings(fn string, ownerId string, quantity int) (error) {
     var err error
     if a.OwnedBy[ownerId].Quantity < quantity {
-        err = errors.New("Insufficient quantity of ownership.")
+        err = newChaincodeError(ERRINSUFFICIENTHOLDINGS, fn, "Insufficient quantity of ownership").withDetail("ownerId", ownerId).withDetail("assetId", a.Id)
         return err
     }
     return nil
 } // end of a.verifyHoldings
 
 
-func (a *Asset) verifyPrice(price float64) (error) {
+func (a *Asset) verifyPrice(fn string, price float64) (error) {
     var err error
     if a.Price != price {
-        err = errors.New("Price does not agree with specifications.")
+        err = newChaincodeError(ERRPRICEMISMATCH, fn, "Price does not agree with specifications").withDetail("assetId", a.Id).withDetail("price", formatAmount(a.Price))
         return err
     }
     return nil
 } // end of a.verifyPrice
 
 
+// Only the given fields change. Nothing changes if any of the values is invalid.
+func (a *Asset) applyUpdate(fn string, fields map[string]string) (error) {
+    var err error
+    fieldErrors := FieldErrors{}
+    updated := *a
+    for field, value := range fields {
+        switch field {
+            case "name":
+                if value == "" {
+                    fieldErrors[field] = "must not be empty"
+                }
+                updated.Name = value
+            case "description":
+                updated.Information.Description = value
+            case "logo":
+                updated.Information.Logo = value
+            case "tag":
+                updated.Tag = value
+            case "approval":
+                if updated.Triggers.Approval, err = strconv.ParseBool(value); err != nil {
+                    fieldErrors[field] = "must be true or false"
+                }
+            case "approvalQty":
+                if updated.Triggers.ApprovalQty, err = strconv.Atoi(value); err != nil || updated.Triggers.ApprovalQty < 0 {
+                    fieldErrors[field] = "must be a non-negative integer"
+                }
+            case "url":
+                updated.Contract.URL = value
+            case "keys":
+                updated.Contract.Keys = strings.Split(value, ",")
+            case "condition":
+                if utils.IsElementInSlice([]string{ "", "less", "more", "equal" }, value) == false {
+                    fieldErrors[field] = "must be one of less, more or equal"
+                }
+                updated.Contract.Condition = value
+            case "value":
+                updated.Contract.Value = value
+            case "discount":
+                if updated.Contract.Discount, err = strconv.ParseFloat(value, 64); err != nil || updated.Contract.Discount < 0 || updated.Contract.Discount > 100 {
+                    fieldErrors[field] = "must be a percentage from 0 to 100"
+                }
+        }
+    }
+    if err = fieldErrors.toError(fn); err != nil {
+        return err
+    }
+    updated.Version = updated.Version + 1
+    *a = updated
+    return nil
+} // end of a.applyUpdate
+
+
+// Whether the approval configuration of the asset puts a trade of this quantity on hold.
+func (a *Asset) needsApproval(quantity int) (bool) {
+    return a.Triggers.Approval == true && quantity > a.Triggers.ApprovalQty
+} // end of a.needsApproval
+
+
+// The issuer configures the approval of its asset and approves the pending trades.
+func (a *Asset) canApprove(ownerId string) (bool) {
+    return ownerId == a.Issuer
+} // end of a.canApprove
+
+
 // ============================================================================================================================
 
 
@@ -216,7 +288,7 @@ func (dcc *DecodedChainCode) createAsset(args []string) (Asset, error) {
     // smart contract: approval, approvalqty
     // 10 = tag
     if len(args) != 10 { 
-        err = errors.New("{\"Error\":\"Incorrect number of arguments\", \"Function\":\"createAsset\"}")
+        err = argumentCountError("createAsset")
         utils.PrintErrorFull("", err)
         return asset, err
     }
@@ -271,14 +343,14 @@ func (dcc *DecodedChainCode) getAsset(stub shim.ChaincodeStubInterface, args []s
     var asset Asset
     var err error
     if len(args) != 1 { // Only needs an asset id.
-        err = errors.New("{\"Error\":\"Incorrect number of arguments\", \"Function\":\"getAsset\"}")
+        err = argumentCountError("getAsset")
         utils.PrintErrorFull("", err)
         return asset, err
     }
     assetId := args[0]
-    assetBytes, err := stub.GetState(assetId)
+    assetBytes, err := stub.GetState(assetKey(assetId))
     if assetBytes == nil {
-        err = errors.New("{\"Error\":\"State " + assetId + " does not exist\", \"Function\":\"getAsset\"}")
+        err = newChaincodeError(ERRNOTFOUND, "getAsset", "Asset " + assetId + " does not exist").withDetail("assetId", assetId)
         utils.PrintErrorFull("getAsset - GetState", err)
         return asset, err
     }
@@ -296,14 +368,27 @@ func (dcc *DecodedChainCode) getAsset(stub shim.ChaincodeStubInterface, args []s
 
 func (dcc *DecodedChainCode) addAssetString(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
     var err error
-    var empty []string
-    if len(args) != 10 { // Id, Name, issuerId, Quantity, Price, description, logo, approval, approvalQty, tag
-        err = errors.New("{\"Error\":\"Incorrect number of arguments\", \"Function\":\"" + fn + "\"}")
+    assetId := args[0]
+    issuerId := args[2]
+    // The JSON variant passes its arguments on to here, so the checks on the values are shared.
+    if err = verifyId(fn, "assetId", assetId); err != nil {
+        utils.PrintErrorFull("addAssetString - verifyId", err)
+        return nil, err
+    }
+    fieldErrors := FieldErrors{}
+    if quantity, parseErr := strconv.Atoi(args[3]); parseErr == nil && quantity <= 0 {
+        fieldErrors["quantity"] = "must be positive"
+    }
+    if price, parseErr := strconv.ParseFloat(args[4], 64); parseErr == nil && price < 0 {
+        fieldErrors["price"] = "must not be negative"
+    }
+    if approvalQty, parseErr := strconv.Atoi(args[8]); parseErr == nil && approvalQty < 0 {
+        fieldErrors["approvalQty"] = "must not be negative"
+    }
+    if err = fieldErrors.toError(fn); err != nil {
         utils.PrintErrorFull("", err)
         return nil, err
     }
-    assetId := args[0]
-    issuerId := args[2]
     // Check if the issuer exists.
     issuer, err := dcc.getOwner(stub, []string{ issuerId })
     if err != nil {
@@ -311,19 +396,22 @@ func (dcc *DecodedChainCode) addAssetString(stub shim.ChaincodeStubInterface, fn
         return nil, err
     }
     // Check if the issuer is validated! - if not the owner cannot create new assets.
-    if issuer.Validated == false {
-        err = errors.New("{\"Error\":\"Owner " + issuerId + " is not validated\", \"Function\":\"" + fn + "\"}")
-        utils.PrintErrorFull("", err)
+    if err = issuer.isValidated(fn); err != nil {
+        utils.PrintErrorFull("addAssetString - isValidated", err)
+        return nil, err
+    }
+    // Frozen or closed owners cannot issue.
+    if err = issuer.isActive(fn); err != nil {
+        utils.PrintErrorFull("addAssetString - isActive", err)
         return nil, err
     }
-    // Get a list of all assets.
-    assetsLedger, err := dcc.getDataArrayStrings(stub, PRIMARYKEY[1], empty)
+    // Check if the asset record exists.
+    existingBytes, err := stub.GetState(assetKey(assetId))
     if err != nil {
-        utils.PrintErrorFull("addAssetString - getDataArrayStrings", err)
+        utils.PrintErrorFull("addAssetString - GetState", err)
         return nil, err
     }
-    // Check if the assetId exists in the current ledger of assets.
-    assetExists := utils.IsElementInSlice(assetsLedger, assetId)
+    assetExists := existingBytes != nil
     if assetExists == false {
         // Create a new asset. This is initialised without the issuer associated.
         newAsset, err := dcc.createAsset(args) // Args has the assetId, assetName, ownerName and quantity
@@ -337,9 +425,8 @@ func (dcc *DecodedChainCode) addAssetString(stub shim.ChaincodeStubInterface, fn
             return nil, err
         }
         // Add asset to the list.
-        _, err = dcc.saveStringToDataArray(stub, PRIMARYKEY[1], assetId, assetsLedger)
-        if err != nil {
-            utils.PrintErrorFull("addAssetString - saveStringToDataArray", err)
+        if err = dcc.addToLedger(stub, PRIMARYKEY[1], assetId); err != nil {
+            utils.PrintErrorFull("addAssetString - addToLedger", err)
             return nil, err
         }
         // ----------------------------------------------
@@ -349,10 +436,13 @@ func (dcc *DecodedChainCode) addAssetString(stub shim.ChaincodeStubInterface, fn
             utils.PrintErrorFull("addAssetString - assignAssetToOwner", err)
             return nil, err
         }
+        recordEvent(stub, EVENTASSETISSUED, assetId, map[string]string{ "issuer": issuerId, "quantity": strconv.Itoa(newAsset.IssuedQty) })
         utils.PrintSuccess("Successfully added a new asset: " + assetId + " to the owner: " + issuerId)
-        return nil, nil
+        result := newInvokeResult(fn, assetId, "Issued")
+        result.addHolding(newAsset, issuerId)
+        return result.toBytes()
     } else {
-        err = errors.New("Asset `" + assetId + "` already exists.")
+        err = newChaincodeError(ERRASSETEXISTS, fn, "Asset " + assetId + " already exists").withDetail("assetId", assetId)
         utils.PrintErrorFull("addAssetString", err)
         return nil, err
     }
@@ -360,11 +450,12 @@ func (dcc *DecodedChainCode) addAssetString(stub shim.ChaincodeStubInterface, fn
 } // end of dcc.addAssetString
 
 
+// Patch-style update: only the fields that are passed change.
 func (dcc *DecodedChainCode) updateAsset(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
     var err error
-    if len(args) != 9 { // assetId, Name, Description, Logo, | url, keys, condition, value, discount
-        err = errors.New("{\"Error\":\"Incorrect number of arguments\", \"Function\":\"" + fn + "\"}")
-        utils.PrintErrorFull("", err)
+    fields, err := dcc.parseFieldPairs(fn, args[2:], ASSETUPDATEFIELDS)
+    if err != nil {
+        utils.PrintErrorFull("updateAsset - parseFieldPairs", err)
         return nil, err
     }
     // Load the current data
@@ -374,72 +465,69 @@ func (dcc *DecodedChainCode) updateAsset(stub shim.ChaincodeStubInterface, fn st
         utils.PrintErrorFull("updateAsset - getAsset", err)
         return nil, err
     }
-    // Deal with the string discount
-    discount, err := strconv.ParseFloat(args[8], 64)
-    if err != nil {
-        utils.PrintErrorFull("updateAsset - ParseFloat", err)
+    // The update has to be based on the current version.
+    if err = dcc.verifyVersion(fn, assetId, args[1], asset.Version); err != nil {
+        utils.PrintErrorFull("updateAsset - verifyVersion", err)
         return nil, err
     }
     // Update the fields.
-    asset.Name = args[1]
-    asset.Information.Description = args[2]
-    asset.Information.Logo = args[3]
-    asset.Contract.URL = args[4]
-    asset.Contract.Keys = strings.Split(args[5], ",")
-    asset.Contract.Condition = args[6]
-    asset.Contract.Value = args[7]
-    asset.Contract.Discount = discount
+    if err = asset.applyUpdate(fn, fields); err != nil {
+        utils.PrintErrorFull("updateAsset - applyUpdate", err)
+        return nil, err
+    }
     // Save the new asset.
     if err = asset.save(stub); err != nil {
         utils.PrintErrorFull("updateAsset - save", err)
         return nil, err
     }
-    return nil, nil
+    recordEvent(stub, EVENTASSETUPDATED, assetId, map[string]string{ "fields": changedFields(fields), "version": strconv.Itoa(asset.Version) })
+    utils.PrintSuccess("Successfully updated asset: " + assetId)
+    result := newInvokeResult(fn, assetId, "Updated")
+    result.Version = asset.Version
+    return result.toBytes()
 } // end of dcc.updateAsset
 
 
-// Function to read all available assets and their information.
-// It has an optional parameter that can filter out assets owned by a specific owner.
+// Function to read a page of assets and their information.
+// Optional JSON argument, see query.go. Filters: tag, issuer, owner (holds some of the asset), from and to (issue date).
 func (dcc *DecodedChainCode) readAllAssets(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
     var err error
-    var emptyArgs []string
-    if len(args) != 0 {
-        err = errors.New("{\"Error\":\"Incorrect number of arguments\", \"Function\":\"" + fn + "\"}")
-        utils.PrintErrorFull("", err)
-        return nil, err
-    }
-    // Get all assets - returns an slice of strings.
-    assetsLedger, err := dcc.getDataArrayStrings(stub, PRIMARYKEY[1], emptyArgs)
+    query, err := dcc.parseListQuery(fn, args, []string{ "tag", "issuer", "owner", "from", "to" })
     if err != nil {
-        utils.PrintErrorFull("readAllAssets - getDataArrayStrings", err)
+        utils.PrintErrorFull("readAllAssets - parseListQuery", err)
         return nil, err
     }
-    if len(assetsLedger) > 0 {
-        // Initialise an empty slice for the output
-        var fullAssetsLedger []Asset
-        // Iterate over all assets and return the asset object.
-        for _, assetId := range assetsLedger {
-            thisAsset, err := dcc.getAsset(stub, []string{ assetId })
-            if err != nil {
-                utils.PrintErrorFull("readAllAssets - getAsset", err)
-                return nil, err
-            }
-            fullAssetsLedger = append(fullAssetsLedger, thisAsset)
-        }
-        // This gives us an slice with assets. Translate to bytes and return
-        fullAssetsLedgerBytes, err := json.Marshal(&fullAssetsLedger)
+    page, err := dcc.readPage(stub, PRIMARYKEY[1], query, func(assetId string) (interface{}, error) {
+        asset, err := dcc.getAsset(stub, []string{ assetId })
         if err != nil {
-            utils.PrintErrorFull("readAllAssets - Marshal", err)
             return nil, err
         }
-        utils.PrintSuccess("Retrieved full information for all assets.")
-        return fullAssetsLedgerBytes, nil
-    } else {
-        return nil, nil
+        if query.Tag != "" && asset.Tag != query.Tag {
+            return nil, nil
+        }
+        if query.Issuer != "" && asset.Issuer != query.Issuer {
+            return nil, nil
+        }
+        if _, ok := asset.OwnedBy[query.Owner]; query.Owner != "" && ok == false {
+            return nil, nil
+        }
+        if query.inDateRange(asset.IssuedTS) == false {
+            return nil, nil
+        }
+        return asset, nil
+    })
+    if err != nil {
+        utils.PrintErrorFull("readAllAssets - readPage", err)
+        return nil, err
+    }
+    pageBytes, err := json.Marshal(&page)
+    if err != nil {
+        utils.PrintErrorFull("readAllAssets - Marshal", err)
+        return nil, err
     }
-    return nil, nil // redundancy
+    utils.PrintSuccess("Retrieved a page of assets.")
+    return pageBytes, nil
 } // end of dcc.readAllAssets
 
 
 // ============================================================================================================================
-
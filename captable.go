@@ -0,0 +1,184 @@
+/*
+
+DECODED HYPERLEDGER APPLICATION
+
+Cap tables of the assets an owner issued. For each asset the holders are listed with their quantity, the quantity
+in escrow for pending sales and their percentage of the issued quantity, largest holder first, along with:
+    - Top-N share: the percentage of the issued quantity held by the N largest holders.
+    - Herfindahl index: the sum of the squared percentages, from 10000 for a single holder towards 0.
+
+The CSV form has one row per holder and is byte-for-byte the same for the same state.
+
+DecodedChainCode functions:
+- getCapTable - private function
+- readCapTable
+
+*/
+
+
+package main
+
+
+import (
+    "bytes"
+    "encoding/csv"
+    "encoding/json"
+    "sort"
+    "strconv"
+
+    "github.com/hyperledger/fabric/core/chaincode/shim"
+
+    utils "github.com/DecodedCo/blockchain-marketplace-chaincode/utils"
+)
+
+
+// ============================================================================================================================
+
+
+// Number of largest holders in the top-N share when not given.
+const DEFAULTTOPHOLDERS = 5
+
+var CAPTABLECSVHEADER = []string{ "assetId", "ownerId", "quantity", "escrowQty", "percentage" }
+
+
+type CapTableEntry struct {
+    OwnerId     string              `json:"ownerId"`
+    Quantity    int                 `json:"quantity"`
+    EscrowQty   int                 `json:"escrowQty"`
+    Percentage  float64             `json:"percentage"` // (Quantity + EscrowQty) / IssuedQty * 100
+}
+
+
+type CapTable struct {
+    AssetId     string              `json:"assetId"`
+    AssetName   string              `json:"assetName"`
+    IssuedQty   int                 `json:"issuedQty"`
+    Holders     []CapTableEntry     `json:"holders"`
+    TopN        int                 `json:"topN"`
+    TopShare    float64             `json:"topShare"`
+    HHI         float64             `json:"herfindahlIndex"`
+}
+
+
+// Sorts holders by the quantity held, largest first, then by owner id.
+type holdersBySize []CapTableEntry
+
+func (h holdersBySize) Len() int { return len(h) }
+func (h holdersBySize) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h holdersBySize) Less(i, j int) bool {
+    if h[i].Quantity + h[i].EscrowQty == h[j].Quantity + h[j].EscrowQty {
+        return h[i].OwnerId < h[j].OwnerId
+    }
+    return h[i].Quantity + h[i].EscrowQty > h[j].Quantity + h[j].EscrowQty
+}
+
+
+// ============================================================================================================================
+
+
+func (dcc *DecodedChainCode) getCapTable(stub shim.ChaincodeStubInterface, assetId string, topN int) (CapTable, error) {
+    var err error
+    asset, err := dcc.getAsset(stub, []string{ assetId })
+    if err != nil {
+        return CapTable{}, err
+    }
+    capTable := CapTable{ AssetId: asset.Id, AssetName: asset.Name, IssuedQty: asset.IssuedQty, Holders: []CapTableEntry{}, TopN: topN }
+    for _, ownerId := range asset.Owners {
+        ownedBy := asset.OwnedBy[ownerId]
+        if ownedBy.Quantity + ownedBy.EscrowQty == 0 {
+            continue
+        }
+        entry := CapTableEntry{ OwnerId: ownerId, Quantity: ownedBy.Quantity, EscrowQty: ownedBy.EscrowQty }
+        if asset.IssuedQty > 0 {
+            entry.Percentage = float64(ownedBy.Quantity + ownedBy.EscrowQty) / float64(asset.IssuedQty) * 100.0
+        }
+        capTable.Holders = append(capTable.Holders, entry)
+    }
+    sort.Sort(holdersBySize(capTable.Holders))
+    for i, entry := range capTable.Holders {
+        if i < topN {
+            capTable.TopShare = capTable.TopShare + entry.Percentage
+        }
+        capTable.HHI = capTable.HHI + entry.Percentage * entry.Percentage
+    }
+    return capTable, nil
+} // end of dcc.getCapTable
+
+
+// Returns the cap tables of every asset an owner issued, in the order they were issued.
+// Args: issuerId, optionally the format (json or csv) and the N of the top-N share.
+func (dcc *DecodedChainCode) readCapTable(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
+    var err error
+    format := "json"
+    if len(args) > 1 {
+        format = args[1]
+    }
+    if format != "json" && format != "csv" {
+        err = newChaincodeError(ERRINVALIDARGUMENTS, fn, "Unknown format " + format).withDetail("format", "must be json or csv")
+        utils.PrintErrorFull("", err)
+        return nil, err
+    }
+    topN := DEFAULTTOPHOLDERS
+    if len(args) > 2 {
+        topN, err = strconv.Atoi(args[2])
+        if err != nil || topN <= 0 {
+            err = newChaincodeError(ERRINVALIDARGUMENTS, fn, "The number of top holders must be a positive number").withDetail("topN", "must be a positive number")
+            utils.PrintErrorFull("", err)
+            return nil, err
+        }
+    }
+    issuer, err := dcc.getOwner(stub, []string{ args[0] })
+    if err != nil {
+        utils.PrintErrorFull("readCapTable - getOwner", err)
+        return nil, err
+    }
+    capTables := []CapTable{}
+    for _, assetId := range issuer.Issued {
+        capTable, err := dcc.getCapTable(stub, assetId, topN)
+        if err != nil {
+            utils.PrintErrorFull("readCapTable - getCapTable", err)
+            return nil, err
+        }
+        capTables = append(capTables, capTable)
+    }
+    if format == "json" {
+        capTablesBytes, err := json.Marshal(&capTables)
+        if err != nil {
+            utils.PrintErrorFull("readCapTable - Marshal", err)
+            return nil, err
+        }
+        utils.PrintSuccess("Retrieved the cap tables of issuer " + args[0])
+        return capTablesBytes, nil
+    }
+    var buffer bytes.Buffer
+    writer := csv.NewWriter(&buffer)
+    if err = writer.Write(CAPTABLECSVHEADER); err != nil {
+        utils.PrintErrorFull("readCapTable - Write", err)
+        return nil, err
+    }
+    for _, capTable := range capTables {
+        for _, entry := range capTable.Holders {
+            row := []string{
+                capTable.AssetId,
+                entry.OwnerId,
+                strconv.Itoa(entry.Quantity),
+                strconv.Itoa(entry.EscrowQty),
+                strconv.FormatFloat(entry.Percentage, 'f', 4, 64),
+            }
+            if err = writer.Write(row); err != nil {
+                utils.PrintErrorFull("readCapTable - Write", err)
+                return nil, err
+            }
+        }
+    }
+    writer.Flush()
+    if err = writer.Error(); err != nil {
+        utils.PrintErrorFull("readCapTable - Flush", err)
+        return nil, err
+    }
+    utils.PrintSuccess("Retrieved the cap tables of issuer " + args[0])
+    return buffer.Bytes(), nil
+} // end of dcc.readCapTable
+
+
+// ============================================================================================================================
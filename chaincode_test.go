@@ -0,0 +1,1037 @@
+/*
+
+DECODED HYPERLEDGER APPLICATION
+
+Tests of the chaincode against the in-memory stub in mockstub_test.go. Every test is a table of invokes that run in
+order on one ledger; after every invoke the ledger invariants are checked (see invariants.go), whether the invoke
+succeeded or not.
+
+*/
+
+
+package main
+
+
+import (
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "math"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+)
+
+
+// ============================================================================================================================
+
+
+// Stands for the id returned by the previous successful invoke, for example a pending transaction.
+const LASTID = "<lastId>"
+
+const TESTEXPIRY = "2099-12-31"
+
+
+type testStep struct {
+    name        string
+    fn          string
+    args        []string
+    admin       bool
+    caller      string // The owner id in the certificate of the caller, if any.
+    code        string // The expected error code, empty when the invoke should succeed.
+    check       func(t *testing.T, stub *mockStub, result InvokeResult)
+}
+
+
+// ============================================================================================================================
+
+
+func newTestLedger(t *testing.T) (*DecodedChainCode, *mockStub) {
+    dcc := new(DecodedChainCode)
+    stub := newMockStub()
+    if _, err := dcc.Init(stub, "init", []string{}); err != nil {
+        t.Fatalf("Init: %v", err)
+    }
+    return dcc, stub
+}
+
+
+func runSteps(t *testing.T, dcc *DecodedChainCode, stub *mockStub, steps []testStep) {
+    lastId := ""
+    for _, step := range steps {
+        args := []string{}
+        for _, arg := range step.args {
+            if arg == LASTID {
+                arg = lastId
+            }
+            args = append(args, arg)
+        }
+        stub.setAttribute(ADMINATTRIBUTE, "")
+        if step.admin {
+            stub.setAttribute(ADMINATTRIBUTE, ADMINROLE)
+        }
+        stub.setAttribute(OWNERATTRIBUTE, step.caller)
+        resultBytes, err := dcc.Invoke(stub, step.fn, args)
+        if step.code == "" && err != nil {
+            t.Fatalf("%s: unexpected error %v", step.name, err)
+        }
+        if step.code != "" {
+            if err == nil {
+                t.Fatalf("%s: expected error %s, the invoke succeeded", step.name, step.code)
+            }
+            if chaincodeErr, ok := err.(*ChaincodeError); ok == false || chaincodeErr.Code != step.code {
+                t.Fatalf("%s: expected error %s, got %v", step.name, step.code, err)
+            }
+        }
+        assertInvariants(t, dcc, stub, step.name)
+        var result InvokeResult
+        if err == nil {
+            if err = json.Unmarshal(resultBytes, &result); err != nil {
+                t.Fatalf("%s: invalid result %s", step.name, string(resultBytes))
+            }
+            lastId = result.Id
+        }
+        if step.check != nil {
+            step.check(t, stub, result)
+        }
+    }
+}
+
+
+func assertInvariants(t *testing.T, dcc *DecodedChainCode, stub *mockStub, name string) {
+    data, err := dcc.loadLedgerData(stub)
+    if err != nil {
+        t.Fatalf("%s: loading the ledger: %v", name, err)
+    }
+    if violations := verifyInvariants(data); len(violations) > 0 {
+        t.Fatalf("%s: ledger invariants broken: %+v", name, violations)
+    }
+}
+
+
+// ============================================================================================================================
+
+
+// Owners issuer (no funds), alice and bob (1000 each), validated, and the asset apple: 1000 units at 5, trades
+// of more than 50 units need approval.
+func marketSetup() ([]testStep) {
+    return []testStep{
+        { name: "add issuer", fn: "addOwner", args: []string{ "issuer", "Issuer", "0", "", "", "" } },
+        { name: "add alice", fn: "addOwner", args: []string{ "alice", "Alice", "1000", "", "", "" } },
+        { name: "add bob", fn: "addOwner", args: []string{ "bob", "Bob", "1000", "", "", "" } },
+        { name: "validate issuer", fn: "validateOwner", args: []string{ "issuer", "reviewer", TESTEXPIRY, "hash" }, admin: true },
+        { name: "validate alice", fn: "validateOwner", args: []string{ "alice", "reviewer", TESTEXPIRY, "hash" }, admin: true },
+        { name: "validate bob", fn: "validateOwner", args: []string{ "bob", "reviewer", TESTEXPIRY, "hash" }, admin: true },
+        { name: "issue apple", fn: "addAssetString", args: []string{ "apple", "Apples", "issuer", "1000", "5", "", "", "true", "50", "" } },
+    }
+}
+
+
+func withSetup(steps ...testStep) ([]testStep) {
+    return append(marketSetup(), steps...)
+}
+
+
+func expectOwner(ownerId string, balance float64, escrowBalance float64) (func(*testing.T, *mockStub, InvokeResult)) {
+    return func(t *testing.T, stub *mockStub, result InvokeResult) {
+        owner, err := new(DecodedChainCode).getOwner(stub, []string{ ownerId })
+        if err != nil {
+            t.Fatalf("getOwner %s: %v", ownerId, err)
+        }
+        if math.Abs(owner.Balance - balance) > BALANCETOLERANCE || math.Abs(owner.EscrowBalance - escrowBalance) > BALANCETOLERANCE {
+            t.Fatalf("owner %s: expected balance %v and escrow %v, got %v and %v", ownerId, balance, escrowBalance, owner.Balance, owner.EscrowBalance)
+        }
+    }
+}
+
+
+func expectHolding(assetId string, ownerId string, quantity int, escrowQty int) (func(*testing.T, *mockStub, InvokeResult)) {
+    return func(t *testing.T, stub *mockStub, result InvokeResult) {
+        asset, err := new(DecodedChainCode).getAsset(stub, []string{ assetId })
+        if err != nil {
+            t.Fatalf("getAsset %s: %v", assetId, err)
+        }
+        ownedBy := asset.OwnedBy[ownerId]
+        if ownedBy.Quantity != quantity || ownedBy.EscrowQty != escrowQty {
+            t.Fatalf("holding of %s in %s: expected %d and %d in escrow, got %d and %d", ownerId, assetId, quantity, escrowQty, ownedBy.Quantity, ownedBy.EscrowQty)
+        }
+    }
+}
+
+
+func expectTransaction(status string, price float64) (func(*testing.T, *mockStub, InvokeResult)) {
+    return func(t *testing.T, stub *mockStub, result InvokeResult) {
+        if result.Transaction == nil || result.Status != status || math.Abs(result.Transaction.Price - price) > BALANCETOLERANCE {
+            t.Fatalf("expected a %s transaction at %v, got %+v", status, price, result)
+        }
+    }
+}
+
+
+func expectLastEvent(eventType string) (func(*testing.T, *mockStub, InvokeResult)) {
+    return func(t *testing.T, stub *mockStub, result InvokeResult) {
+        if len(stub.events) == 0 {
+            t.Fatalf("expected a %s event, no event was set", eventType)
+        }
+        var payload EventPayload
+        if err := json.Unmarshal(stub.events[len(stub.events) - 1].Payload, &payload); err != nil {
+            t.Fatalf("invalid event payload: %v", err)
+        }
+        if len(payload.Events) != 1 || payload.Events[0].Type != eventType {
+            t.Fatalf("expected a %s event, got %+v", eventType, payload.Events)
+        }
+    }
+}
+
+
+// No records are left, only the settings.
+func expectEmptyLedger() (func(*testing.T, *mockStub, InvokeResult)) {
+    return func(t *testing.T, stub *mockStub, result InvokeResult) {
+        for key := range stub.state {
+            if strings.HasPrefix(key, ENTITYPREFIX["system"]) == false {
+                t.Fatalf("expected an empty ledger, found %s", key)
+            }
+        }
+    }
+}
+
+
+// Runs all the checks of a step.
+func all(checks ...func(*testing.T, *mockStub, InvokeResult)) (func(*testing.T, *mockStub, InvokeResult)) {
+    return func(t *testing.T, stub *mockStub, result InvokeResult) {
+        for _, check := range checks {
+            check(t, stub, result)
+        }
+    }
+}
+
+
+// ============================================================================================================================
+
+
+func TestInit(t *testing.T) {
+    tests := []struct {
+        name    string
+        steps   []testStep
+    }{
+        { "empty ledger", []testStep{
+            { name: "init", fn: "init", args: []string{}, admin: true, check: expectLastEvent(EVENTLEDGERINITIALISED) },
+        } },
+        { "not an admin", []testStep{
+            { name: "init", fn: "init", args: []string{}, code: ERRNOTADMIN },
+        } },
+        { "unknown argument", []testStep{
+            { name: "init with an argument", fn: "init", args: []string{ "reset" }, admin: true, code: ERRINVALIDARGUMENTS },
+            { name: "init with two arguments", fn: "init", args: []string{ RESETCONFIRMATION, "reset" }, admin: true, code: ERRINVALIDARGUMENTS },
+        } },
+        { "populated ledger is kept", withSetup(
+            testStep{ name: "init", fn: "init", args: []string{}, admin: true, code: ERRLEDGERNOTEMPTY, check: expectHolding("apple", "issuer", 1000, 0) },
+            testStep{ name: "init confirmed by a non-admin", fn: "init", args: []string{ RESETCONFIRMATION }, code: ERRNOTADMIN },
+            testStep{ name: "init with a wrong confirmation", fn: "init", args: []string{ "yes" }, admin: true, code: ERRINVALIDARGUMENTS },
+        ) },
+        { "populated ledger reset by an admin", withSetup(
+            testStep{ name: "init", fn: "init", args: []string{ RESETCONFIRMATION }, admin: true, check: expectEmptyLedger() },
+        ) },
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            dcc, stub := newTestLedger(t)
+            runSteps(t, dcc, stub, test.steps)
+        })
+    }
+    t.Run("deploy", func(t *testing.T) {
+        _, stub := newTestLedger(t)
+        expectLastEvent(EVENTLEDGERINITIALISED)(t, stub, InvokeResult{})
+    })
+    t.Run("deploy over a populated ledger", func(t *testing.T) {
+        dcc, stub := newTestLedger(t)
+        runSteps(t, dcc, stub, marketSetup())
+        stub.setAttribute(ADMINATTRIBUTE, ADMINROLE)
+        stub.events = nil
+        if _, err := dcc.Init(stub, "init", []string{ RESETCONFIRMATION }); err != nil {
+            t.Fatalf("Init: %v", err)
+        }
+        var payload EventPayload
+        if len(stub.events) != 1 || json.Unmarshal(stub.events[0].Payload, &payload) != nil {
+            t.Fatalf("expected one event, got %d", len(stub.events))
+        }
+        if len(payload.Events) != 2 || payload.Events[0].Type != EVENTLEDGERRESET || payload.Events[1].Type != EVENTLEDGERINITIALISED {
+            t.Fatalf("expected the reset and the initialisation, got %+v", payload.Events)
+        }
+    })
+}
+
+
+func TestResetLedger(t *testing.T) {
+    tests := []struct {
+        name    string
+        steps   []testStep
+    }{
+        { "admin", withSetup(
+            testStep{ name: "alice buys 100", fn: "transactAsset", args: []string{ "apple", "issuer", "alice", "100", "5", "FALSE" } },
+            testStep{ name: "halt apple", fn: "haltAssetTrading", args: []string{ "apple", "MAINTENANCE", "test" }, admin: true },
+            testStep{ name: "add dave", fn: "addOwner", args: []string{ "dave", "Dave", "0", "", "", "" } },
+            testStep{ name: "close dave", fn: "closeOwner", args: []string{ "dave", "test" }, admin: true },
+            testStep{ name: "reset", fn: "resetLedger", args: []string{ RESETCONFIRMATION }, admin: true,
+                check: all(expectEmptyLedger(), expectLastEvent(EVENTLEDGERRESET)) },
+            testStep{ name: "init", fn: "init", args: []string{}, admin: true },
+            testStep{ name: "add alice again", fn: "addOwner", args: []string{ "alice", "Alice", "10", "", "", "" }, check: expectOwner("alice", 10, 0) },
+        ) },
+        { "not an admin", withSetup(
+            testStep{ name: "reset", fn: "resetLedger", args: []string{ RESETCONFIRMATION }, code: ERRNOTADMIN, check: expectHolding("apple", "issuer", 1000, 0) },
+        ) },
+        { "without the confirmation", withSetup(
+            testStep{ name: "reset", fn: "resetLedger", args: []string{}, admin: true, code: ERRINVALIDARGUMENTS },
+            testStep{ name: "reset", fn: "resetLedger", args: []string{ "yes" }, admin: true, code: ERRINVALIDARGUMENTS },
+        ) },
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            dcc, stub := newTestLedger(t)
+            runSteps(t, dcc, stub, test.steps)
+        })
+    }
+}
+
+
+// Turns the ledger back into one written before the schema was versioned: the owners under their bare ids with
+// the Owners ledger as a JSON array, and the pending transactions without their escrow.
+func downgradeToLegacy(t *testing.T, stub *mockStub) {
+    delete(stub.state, systemKey(SCHEMAVERSIONKEY))
+    ownerIds := []string{}
+    for key, value := range stub.state {
+        if strings.HasPrefix(key, ledgerEntryPrefix(PRIMARYKEY[0])) {
+            ownerIds = append(ownerIds, string(value))
+            delete(stub.state, key)
+        }
+    }
+    for _, ownerId := range ownerIds {
+        stub.state[ownerId] = stub.state[ownerKey(ownerId)]
+        delete(stub.state, ownerKey(ownerId))
+    }
+    stub.state[PRIMARYKEY[0]], _ = json.Marshal(ownerIds)
+    for key, value := range stub.state {
+        if strings.HasPrefix(key, ledgerEntryPrefix(PRIMARYKEY[3])) {
+            var transaction map[string]interface{}
+            if err := json.Unmarshal(stub.state[transactionKey(string(value))], &transaction); err != nil {
+                t.Fatalf("downgrade: %v", err)
+            }
+            delete(transaction, "escrowed")
+            stub.state[transactionKey(string(value))], _ = json.Marshal(transaction)
+        }
+    }
+}
+
+
+func expectSchemaVersion(version int) (func(*testing.T, *mockStub, InvokeResult)) {
+    return func(t *testing.T, stub *mockStub, result InvokeResult) {
+        schemaBytes, err := new(DecodedChainCode).Query(stub, "readSchemaVersion", []string{})
+        if err != nil {
+            t.Fatalf("readSchemaVersion: %v", err)
+        }
+        var schemaVersion SchemaVersion
+        if err = json.Unmarshal(schemaBytes, &schemaVersion); err != nil {
+            t.Fatalf("readSchemaVersion: %v", err)
+        }
+        if schemaVersion.Version != version || schemaVersion.Latest != latestSchemaVersion() || len(schemaVersion.Migrations) != len(MIGRATIONS) {
+            t.Fatalf("expected schema version %d of %d, got %s", version, latestSchemaVersion(), string(schemaBytes))
+        }
+        for _, migration := range schemaVersion.Migrations {
+            if migration.Applied != (migration.Version <= version) {
+                t.Fatalf("migration %d applied: %v, the schema is at version %d", migration.Version, migration.Applied, version)
+            }
+        }
+    }
+}
+
+
+func TestSchemaMigration(t *testing.T) {
+    pendingTrade := testStep{ name: "alice buys 100", fn: "transactAsset", args: []string{ "apple", "issuer", "alice", "100", "5", "FALSE" } }
+    t.Run("new ledger", func(t *testing.T) {
+        dcc, stub := newTestLedger(t)
+        expectSchemaVersion(latestSchemaVersion())(t, stub, InvokeResult{})
+        runSteps(t, dcc, stub, withSetup(
+            testStep{ name: "reset", fn: "resetLedger", args: []string{ RESETCONFIRMATION }, admin: true, check: expectSchemaVersion(latestSchemaVersion()) },
+        ))
+    })
+    t.Run("legacy ledger upgraded by init", func(t *testing.T) {
+        dcc, stub := newTestLedger(t)
+        runSteps(t, dcc, stub, withSetup(pendingTrade))
+        downgradeToLegacy(t, stub)
+        resultBytes, err := dcc.Init(stub, "init", []string{})
+        if err != nil {
+            t.Fatalf("Init: %v", err)
+        }
+        var result InvokeResult
+        if err = json.Unmarshal(resultBytes, &result); err != nil || result.Status != "Migrated" || result.Migration == nil {
+            t.Fatalf("Init: invalid result %s", string(resultBytes))
+        }
+        expectLastEvent(EVENTSCHEMAMIGRATED)(t, stub, result)
+        report := result.Migration
+        if report.From != 0 || report.To != latestSchemaVersion() || len(report.Migrations) != len(MIGRATIONS) {
+            t.Fatalf("expected a migration from 0 to %d, got %s", latestSchemaVersion(), string(resultBytes))
+        }
+        if report.Migrations[0].Changed["owner"] != 3 || report.Migrations[0].Changed["ledger"] != 1 || report.Migrations[1].Changed["transaction"] != 1 {
+            t.Fatalf("unexpected changes %s", string(resultBytes))
+        }
+        assertInvariants(t, dcc, stub, "init")
+        pending, err := dcc.getDataArrayStrings(stub, PRIMARYKEY[3], []string{})
+        if err != nil || len(pending) != 1 {
+            t.Fatalf("expected one pending transaction, got %v (%v)", pending, err)
+        }
+        runSteps(t, dcc, stub, []testStep{
+            { name: "migrated", fn: "init", args: []string{}, admin: true, code: ERRLEDGERNOTEMPTY,
+                check: all(expectSchemaVersion(latestSchemaVersion()), expectOwner("alice", 500, 500), expectHolding("apple", "issuer", 900, 100)) },
+            { name: "approve", fn: "approveTransaction", args: pending, caller: "issuer",
+                check: all(expectTransaction("Approved", 5), expectOwner("alice", 500, 0), expectOwner("issuer", 500, 0)) },
+        })
+    })
+    t.Run("ledger of a newer chaincode", func(t *testing.T) {
+        dcc, stub := newTestLedger(t)
+        stub.PutState(systemKey(SCHEMAVERSIONKEY), []byte(strconv.Itoa(latestSchemaVersion() + 1)))
+        runSteps(t, dcc, stub, []testStep{
+            { name: "init", fn: "init", args: []string{}, admin: true, code: ERRSCHEMAVERSION },
+        })
+    })
+}
+
+
+func exportSnapshot(t *testing.T, dcc *DecodedChainCode, stub *mockStub) (string) {
+    stub.setAttribute(ADMINATTRIBUTE, ADMINROLE)
+    defer stub.setAttribute(ADMINATTRIBUTE, "")
+    snapshotBytes, err := dcc.Query(stub, "exportLedger", []string{})
+    if err != nil {
+        t.Fatalf("exportLedger: %v", err)
+    }
+    return string(snapshotBytes)
+}
+
+
+func TestExportImportLedger(t *testing.T) {
+    dcc, stub := newTestLedger(t)
+    runSteps(t, dcc, stub, withSetup(
+        testStep{ name: "alice buys 10", fn: "transactAsset", args: []string{ "apple", "issuer", "alice", "10", "5", "FALSE" } },
+        testStep{ name: "alice buys 100", fn: "transactAsset", args: []string{ "apple", "issuer", "alice", "100", "5", "FALSE" } },
+        testStep{ name: "add dave", fn: "addOwner", args: []string{ "dave", "Dave", "0", "", "", "" } },
+        testStep{ name: "close dave", fn: "closeOwner", args: []string{ "dave", "test" }, admin: true },
+    ))
+    snapshot := exportSnapshot(t, dcc, stub)
+    if again := exportSnapshot(t, dcc, stub); again != snapshot {
+        t.Fatalf("exporting twice gave different snapshots:\n%s\n%s", snapshot, again)
+    }
+    var decoded LedgerSnapshot
+    if err := json.Unmarshal([]byte(snapshot), &decoded); err != nil {
+        t.Fatalf("invalid snapshot %s", snapshot)
+    }
+    if decoded.Format != SNAPSHOTFORMAT || decoded.SchemaVersion != latestSchemaVersion() || len(decoded.Owners) != 4 || len(decoded.Transactions) != 2 ||
+        len(decoded.Ledgers[assetTransactionsLedger("apple")]) != 2 || len(decoded.Ledgers[PRIMARYKEY[3]]) != 1 {
+        t.Fatalf("unexpected snapshot %s", snapshot)
+    }
+    if _, err := dcc.Query(stub, "exportLedger", []string{}); err == nil || err.(*ChaincodeError).Code != ERRNOTADMIN {
+        t.Fatalf("expected a non-admin export to be refused with %s, got %v", ERRNOTADMIN, err)
+    }
+    tampered := func(change func(*LedgerSnapshot)) (string) {
+        var copied LedgerSnapshot
+        json.Unmarshal([]byte(snapshot), &copied)
+        change(&copied)
+        copiedBytes, _ := json.Marshal(&copied)
+        return string(copiedBytes)
+    }
+    tests := []struct {
+        name    string
+        steps   []testStep
+    }{
+        { "into an empty ledger", []testStep{
+            { name: "import", fn: "importLedger", args: []string{ snapshot }, admin: true,
+                check: all(expectOwner("alice", 450, 500), expectOwner("issuer", 50, 0), expectOwner("dave", 0, 0),
+                    expectHolding("apple", "alice", 10, 0), expectHolding("apple", "issuer", 890, 100), expectLastEvent(EVENTLEDGERIMPORTED)) },
+            { name: "approve", fn: "approveTransaction", args: decoded.Ledgers[PRIMARYKEY[3]], caller: "issuer",
+                check: all(expectOwner("alice", 450, 0), expectHolding("apple", "alice", 110, 0)) },
+        } },
+        { "into a populated ledger", withSetup(
+            testStep{ name: "import", fn: "importLedger", args: []string{ snapshot }, admin: true, code: ERRLEDGERNOTEMPTY, check: expectOwner("alice", 1000, 0) },
+        ) },
+        { "not an admin", []testStep{
+            { name: "import", fn: "importLedger", args: []string{ snapshot }, code: ERRNOTADMIN, check: expectEmptyLedger() },
+        } },
+        { "invalid snapshot", []testStep{
+            { name: "not JSON", fn: "importLedger", args: []string{ "snapshot" }, admin: true, code: ERRINVALIDARGUMENTS },
+            { name: "unknown field", fn: "importLedger", args: []string{ `{"format":1,"owner":{}}` }, admin: true, code: ERRINVALIDARGUMENTS },
+            { name: "other format", fn: "importLedger", args: []string{ tampered(func(s *LedgerSnapshot) { s.Format = 2 }) }, admin: true, code: ERRINVALIDARGUMENTS },
+            { name: "other schema", fn: "importLedger", args: []string{ tampered(func(s *LedgerSnapshot) { s.SchemaVersion = 1 }) }, admin: true, code: ERRSCHEMAVERSION },
+            { name: "record under another id", fn: "importLedger", admin: true, code: ERRINVALIDARGUMENTS,
+                args: []string{ tampered(func(s *LedgerSnapshot) { s.Owners["eve"] = s.Owners["alice"] }) } },
+            { name: "unknown ledger", fn: "importLedger", admin: true, code: ERRINVALIDARGUMENTS,
+                args: []string{ tampered(func(s *LedgerSnapshot) { s.Ledgers[assetTransactionsLedger("pear")] = s.Ledgers[PRIMARYKEY[2]] }) } },
+            { name: "units created", fn: "importLedger", admin: true, code: ERRINVARIANTSVIOLATED, check: expectEmptyLedger(),
+                args: []string{ tampered(func(s *LedgerSnapshot) { asset := s.Assets["apple"]; asset.IssuedQty = 2000; s.Assets["apple"] = asset }) } },
+        } },
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            dcc, stub := newTestLedger(t)
+            runSteps(t, dcc, stub, test.steps)
+        })
+    }
+    t.Run("after a reconcile", func(t *testing.T) {
+        dcc, stub := newTestLedger(t)
+        runSteps(t, dcc, stub, withSetup(
+            testStep{ name: "reconcile", fn: "reconcileOwnership", args: []string{}, admin: true },
+        ))
+        reconciled := exportSnapshot(t, dcc, stub)
+        if strings.Contains(reconciled, REPAIRLEDGER) {
+            t.Fatalf("the repair log is exported: %s", reconciled)
+        }
+        dcc, stub = newTestLedger(t)
+        runSteps(t, dcc, stub, []testStep{
+            { name: "import", fn: "importLedger", args: []string{ reconciled }, admin: true, check: expectHolding("apple", "issuer", 1000, 0) },
+        })
+    })
+    t.Run("round trip", func(t *testing.T) {
+        dcc, stub := newTestLedger(t)
+        runSteps(t, dcc, stub, []testStep{ { name: "import", fn: "importLedger", args: []string{ snapshot }, admin: true } })
+        if exported := exportSnapshot(t, dcc, stub); exported != snapshot {
+            t.Fatalf("the imported ledger exports differently:\n%s\n%s", snapshot, exported)
+        }
+    })
+}
+
+
+func TestAddOwner(t *testing.T) {
+    tests := []struct {
+        name    string
+        steps   []testStep
+    }{
+        { "new owner", []testStep{
+            { name: "add alice", fn: "addOwner", args: []string{ "alice", "Alice", "1000", "", "", "" }, check: expectOwner("alice", 1000, 0) },
+        } },
+        { "string variant", []testStep{
+            { name: "add alice", fn: "addOwnerString", args: []string{ "alice", "Alice", "250.5", "", "", "" }, check: expectOwner("alice", 250.5, 0) },
+        } },
+        { "existing owner", []testStep{
+            { name: "add alice", fn: "addOwner", args: []string{ "alice", "Alice", "1000", "", "", "" } },
+            { name: "add alice again", fn: "addOwner", args: []string{ "alice", "Alice", "5", "", "", "" }, code: ERROWNEREXISTS, check: expectOwner("alice", 1000, 0) },
+        } },
+        { "balance is not a number", []testStep{
+            { name: "add alice", fn: "addOwner", args: []string{ "alice", "Alice", "lots", "", "", "" }, code: ERRINVALIDARGUMENTS },
+        } },
+        { "id with a key separator", []testStep{
+            { name: "add a:b", fn: "addOwner", args: []string{ "a" + KEYSEPARATOR + "b", "A", "0", "", "", "" }, code: ERRINVALIDARGUMENTS, check: expectEmptyLedger() },
+            { name: "add without an id", fn: "addOwner", args: []string{ "", "A", "0", "", "", "" }, code: ERRINVALIDARGUMENTS, check: expectEmptyLedger() },
+        } },
+        { "negative balance", []testStep{
+            { name: "add alice", fn: "addOwner", args: []string{ "alice", "Alice", "-1", "", "", "" }, code: ERRINVALIDARGUMENTS },
+            { name: "add alice as JSON", fn: "addOwnerJSON", args: []string{ `{"ownerId":"alice","name":"Alice","balance":-1}` }, code: ERRINVALIDARGUMENTS, check: expectEmptyLedger() },
+        } },
+        { "missing arguments", []testStep{
+            { name: "add alice", fn: "addOwner", args: []string{ "alice", "Alice", "1000" }, code: ERRINVALIDARGUMENTS },
+        } },
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            dcc, stub := newTestLedger(t)
+            runSteps(t, dcc, stub, test.steps)
+        })
+    }
+}
+
+
+func expectValidated(ownerId string, validated bool) (func(*testing.T, *mockStub, InvokeResult)) {
+    return func(t *testing.T, stub *mockStub, result InvokeResult) {
+        var owner Owner
+        if err := json.Unmarshal(stub.state[ownerKey(ownerId)], &owner); err != nil {
+            t.Fatalf("owner %s: %v", ownerId, err)
+        }
+        if owner.Validated != validated {
+            t.Fatalf("owner %s: expected validated %v, got %v", ownerId, validated, owner.Validated)
+        }
+    }
+}
+
+
+func TestOwnerValidation(t *testing.T) {
+    addDave := testStep{ name: "add dave", fn: "addOwner", args: []string{ "dave", "Dave", "0", "", "", "" } }
+    validateDave := testStep{ name: "validate dave", fn: "validateOwner", args: []string{ "dave", "reviewer", TESTEXPIRY, "hash" }, admin: true, check: expectValidated("dave", true) }
+    tests := []struct {
+        name    string
+        steps   []testStep
+    }{
+        { "validate and revoke", []testStep{
+            addDave,
+            validateDave,
+            validateDave,
+            { name: "revoke", fn: "revokeOwnerValidation", args: []string{ "dave", "test" }, admin: true, check: expectValidated("dave", false) },
+            { name: "revoke again", fn: "revokeOwnerValidation", args: []string{ "dave", "test" }, admin: true, check: expectValidated("dave", false) },
+        } },
+        { "not an admin", []testStep{
+            addDave,
+            { name: "validate", fn: "validateOwner", args: []string{ "dave", "reviewer", TESTEXPIRY, "hash" }, code: ERRNOTADMIN, check: expectValidated("dave", false) },
+            validateDave,
+            { name: "revoke", fn: "revokeOwnerValidation", args: []string{ "dave", "test" }, code: ERRNOTADMIN, check: expectValidated("dave", true) },
+        } },
+        { "closed owner", []testStep{
+            addDave,
+            validateDave,
+            { name: "close dave", fn: "closeOwner", args: []string{ "dave", "test" }, admin: true },
+            { name: "validate", fn: "validateOwner", args: []string{ "dave", "reviewer", TESTEXPIRY, "hash" }, admin: true, code: ERROWNERCLOSED },
+            { name: "revoke", fn: "revokeOwnerValidation", args: []string{ "dave", "test" }, admin: true, code: ERROWNERCLOSED },
+        } },
+        { "invalid expiry", []testStep{
+            addDave,
+            { name: "malformed date", fn: "validateOwner", args: []string{ "dave", "reviewer", "31-12-2099", "hash" }, admin: true, code: ERRINVALIDARGUMENTS, check: expectValidated("dave", false) },
+            { name: "past date", fn: "validateOwner", args: []string{ "dave", "reviewer", "2000-01-01", "hash" }, admin: true, code: ERRINVALIDARGUMENTS, check: expectValidated("dave", false) },
+        } },
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            dcc, stub := newTestLedger(t)
+            runSteps(t, dcc, stub, test.steps)
+        })
+    }
+}
+
+
+func TestJSONArguments(t *testing.T) {
+    tests := []struct {
+        name    string
+        fn      string
+        arg     string
+        details map[string]string // The expected field errors, nil when the argument is refused as a whole.
+    }{
+        { "every bad field", "addOwnerJSON", `{"ownerId":1,"balance":"lots","tagg":""}`,
+            map[string]string{ "ownerId": "must be of type string", "balance": "must be of type float64", "tagg": "is not a known field", "name": "is required" } },
+        { "nested unknown field", "updateAssetJSON", `{"assetId":"apple","version":0,"apiTrigger":{"url":"http://x","rate":1}}`,
+            map[string]string{ "apiTrigger": "has an unknown field rate" } },
+        { "data after the object", "addOwnerJSON", `{"ownerId":"alice","name":"Alice","balance":1} {}`, nil },
+        { "not an object", "addOwnerJSON", `["alice"]`, nil },
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            dcc, stub := newTestLedger(t)
+            _, err := dcc.Invoke(stub, test.fn, []string{ test.arg })
+            chaincodeErr, ok := err.(*ChaincodeError)
+            if ok == false || chaincodeErr.Code != ERRINVALIDARGUMENTS {
+                t.Fatalf("expected error %s, got %v", ERRINVALIDARGUMENTS, err)
+            }
+            if test.details != nil && (len(chaincodeErr.Details) != len(test.details) || fmt.Sprint(chaincodeErr.Details) != fmt.Sprint(test.details)) {
+                t.Fatalf("expected details %v, got %v", test.details, chaincodeErr.Details)
+            }
+        })
+    }
+}
+
+
+func TestPageTokens(t *testing.T) {
+    dcc, stub := newTestLedger(t)
+    runSteps(t, dcc, stub, marketSetup())
+    readPage := func(fn string, query string) (Page, error) {
+        var page Page
+        pageBytes, err := dcc.Query(stub, fn, []string{ query })
+        if err == nil {
+            err = json.Unmarshal(pageBytes, &page)
+        }
+        return page, err
+    }
+    first, err := readPage("readAllOwners", `{"pageSize":2}`)
+    if err != nil || len(first.Items) != 2 || first.NextToken == "" {
+        t.Fatalf("expected two owners and a token, got %+v (%v)", first, err)
+    }
+    last, err := readPage("readAllOwners", `{"pageSize":2,"pageToken":"` + first.NextToken + `"}`)
+    if err != nil || len(last.Items) != 1 || last.NextToken != "" {
+        t.Fatalf("expected the last owner without a token, got %+v (%v)", last, err)
+    }
+    refused := []struct {
+        fn      string
+        query   string
+    }{
+        { "readAllOwners", `{"pageSize":2,"status":"validated","pageToken":"` + first.NextToken + `"}` },
+        { "readAllAssets", `{"pageSize":2,"pageToken":"` + first.NextToken + `"}` },
+        { "readAllOwners", `{"pageToken":"` + base64.URLEncoding.EncodeToString([]byte("bob")) + `"}` },
+    }
+    for _, query := range refused {
+        _, err = readPage(query.fn, query.query)
+        if chaincodeErr, ok := err.(*ChaincodeError); ok == false || chaincodeErr.Details["pageToken"] == "" {
+            t.Fatalf("%s %s: expected the page token to be refused, got %v", query.fn, query.query, err)
+        }
+    }
+}
+
+
+func TestAddAssetString(t *testing.T) {
+    addIssuer := testStep{ name: "add issuer", fn: "addOwner", args: []string{ "issuer", "Issuer", "0", "", "", "" } }
+    validateIssuer := testStep{ name: "validate issuer", fn: "validateOwner", args: []string{ "issuer", "reviewer", TESTEXPIRY, "hash" }, admin: true }
+    issueApple := []string{ "apple", "Apples", "issuer", "1000", "5", "", "", "true", "50", "" }
+    tests := []struct {
+        name    string
+        steps   []testStep
+    }{
+        { "validated issuer", []testStep{
+            addIssuer,
+            validateIssuer,
+            { name: "issue apple", fn: "addAssetString", args: issueApple, check: all(expectHolding("apple", "issuer", 1000, 0), expectLastEvent(EVENTASSETISSUED)) },
+        } },
+        { "unknown issuer", []testStep{
+            { name: "issue apple", fn: "addAssetString", args: issueApple, code: ERRNOTFOUND },
+        } },
+        { "issuer not validated", []testStep{
+            addIssuer,
+            { name: "issue apple", fn: "addAssetString", args: issueApple, code: ERRNOTVALIDATED },
+        } },
+        { "existing asset", []testStep{
+            addIssuer,
+            validateIssuer,
+            { name: "issue apple", fn: "addAssetString", args: issueApple },
+            { name: "issue apple again", fn: "addAssetString", args: issueApple, code: ERRASSETEXISTS, check: expectHolding("apple", "issuer", 1000, 0) },
+        } },
+        { "id with a key separator", []testStep{
+            addIssuer,
+            validateIssuer,
+            { name: "issue apple:red", fn: "addAssetString", args: []string{ "apple" + KEYSEPARATOR + "red", "Apples", "issuer", "1000", "5", "", "", "true", "50", "" }, code: ERRINVALIDARGUMENTS },
+        } },
+        { "negative price", []testStep{
+            addIssuer,
+            validateIssuer,
+            { name: "issue apple", fn: "addAssetString", args: []string{ "apple", "Apples", "issuer", "1000", "-5", "", "", "true", "50", "" }, code: ERRINVALIDARGUMENTS },
+            { name: "issue no apples", fn: "addAssetString", args: []string{ "apple", "Apples", "issuer", "0", "5", "", "", "true", "50", "" }, code: ERRINVALIDARGUMENTS },
+        } },
+        { "quantity is not a number", []testStep{
+            addIssuer,
+            validateIssuer,
+            { name: "issue apple", fn: "addAssetString", args: []string{ "apple", "Apples", "issuer", "many", "5", "", "", "true", "50", "" }, code: ERRINVALIDARGUMENTS },
+        } },
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            dcc, stub := newTestLedger(t)
+            runSteps(t, dcc, stub, test.steps)
+        })
+    }
+}
+
+
+func TestTransactAsset(t *testing.T) {
+    tests := []struct {
+        name    string
+        steps   []testStep
+    }{
+        { "straight through", withSetup(
+            testStep{ name: "alice buys 10", fn: "transactAsset", args: []string{ "apple", "issuer", "alice", "10", "5", "FALSE" },
+                check: all(expectTransaction("Validated", 5), expectOwner("alice", 950, 0), expectOwner("issuer", 50, 0),
+                    expectHolding("apple", "alice", 10, 0), expectHolding("apple", "issuer", 990, 0), expectLastEvent(EVENTTRADEVALIDATED)) },
+            testStep{ name: "alice sells 10 to bob", fn: "transactAsset", args: []string{ "apple", "alice", "bob", "10", "5", "FALSE" },
+                check: all(expectOwner("alice", 1000, 0), expectOwner("bob", 950, 0), expectHolding("apple", "alice", 0, 0), expectHolding("apple", "bob", 10, 0)) },
+        ) },
+        { "pending above the approval quantity", withSetup(
+            testStep{ name: "alice buys 100", fn: "transactAsset", args: []string{ "apple", "issuer", "alice", "100", "5", "FALSE" },
+                check: all(expectTransaction("Pending", 5), expectOwner("alice", 500, 500), expectOwner("issuer", 0, 0),
+                    expectHolding("apple", "issuer", 900, 100), expectLastEvent(EVENTTRADEPENDING)) },
+        ) },
+        { "pending on request", withSetup(
+            testStep{ name: "alice buys 10", fn: "transactAsset", args: []string{ "apple", "issuer", "alice", "10", "5", "TRUE" },
+                check: all(expectTransaction("Pending", 5), expectOwner("alice", 950, 50), expectHolding("apple", "issuer", 990, 10)) },
+        ) },
+        { "seller keeps an asset it has in escrow", withSetup(
+            testStep{ name: "alice buys 10", fn: "transactAsset", args: []string{ "apple", "issuer", "alice", "10", "5", "FALSE" } },
+            testStep{ name: "alice sells 4 to bob pending", fn: "transactAsset", args: []string{ "apple", "alice", "bob", "4", "5", "TRUE" } },
+            testStep{ name: "alice sells 6 to the issuer", fn: "transactAsset", args: []string{ "apple", "alice", "issuer", "6", "5", "FALSE" },
+                check: expectHolding("apple", "alice", 0, 4) },
+        ) },
+        { "price does not match", withSetup(
+            testStep{ name: "alice buys at 4", fn: "transactAsset", args: []string{ "apple", "issuer", "alice", "10", "4", "FALSE" }, code: ERRPRICEMISMATCH },
+        ) },
+        { "insufficient balance", withSetup(
+            testStep{ name: "alice buys 201", fn: "transactAsset", args: []string{ "apple", "issuer", "alice", "201", "5", "FALSE" }, code: ERRINSUFFICIENTBALANCE,
+                check: expectOwner("alice", 1000, 0) },
+        ) },
+        { "insufficient holdings", withSetup(
+            testStep{ name: "alice buys 10", fn: "transactAsset", args: []string{ "apple", "issuer", "alice", "10", "5", "FALSE" } },
+            testStep{ name: "alice sells 20 to bob", fn: "transactAsset", args: []string{ "apple", "alice", "bob", "20", "5", "FALSE" }, code: ERRINSUFFICIENTHOLDINGS },
+        ) },
+        { "seller does not hold the asset", withSetup(
+            testStep{ name: "bob sells to alice", fn: "transactAsset", args: []string{ "apple", "bob", "alice", "1", "5", "FALSE" }, code: ERROWNERSHIPMISMATCH },
+        ) },
+        { "buyer not validated", withSetup(
+            testStep{ name: "add carol", fn: "addOwner", args: []string{ "carol", "Carol", "1000", "", "", "" } },
+            testStep{ name: "carol buys 10", fn: "transactAsset", args: []string{ "apple", "issuer", "carol", "10", "5", "FALSE" }, code: ERRNOTVALIDATED },
+        ) },
+        { "buyer frozen", withSetup(
+            testStep{ name: "freeze alice", fn: "freezeOwner", args: []string{ "alice", "test" }, admin: true },
+            testStep{ name: "alice buys 10", fn: "transactAsset", args: []string{ "apple", "issuer", "alice", "10", "5", "FALSE" }, code: ERROWNERFROZEN },
+        ) },
+        { "quantity is not a number", withSetup(
+            testStep{ name: "alice buys some", fn: "transactAsset", args: []string{ "apple", "issuer", "alice", "some", "5", "FALSE" }, code: ERRINVALIDARGUMENTS },
+        ) },
+        { "quantity is not positive", withSetup(
+            testStep{ name: "alice buys none", fn: "transactAsset", args: []string{ "apple", "issuer", "alice", "0", "5", "FALSE" }, code: ERRINVALIDARGUMENTS },
+            testStep{ name: "alice sells 10", fn: "transactAsset", args: []string{ "apple", "issuer", "alice", "-10", "5", "FALSE" }, code: ERRINVALIDARGUMENTS,
+                check: all(expectOwner("alice", 1000, 0), expectHolding("apple", "issuer", 1000, 0)) },
+        ) },
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            dcc, stub := newTestLedger(t)
+            runSteps(t, dcc, stub, test.steps)
+        })
+    }
+}
+
+
+func TestApproveAndDeclineTransaction(t *testing.T) {
+    pendingTrade := testStep{ name: "alice buys 100", fn: "transactAsset", args: []string{ "apple", "issuer", "alice", "100", "5", "FALSE" } }
+    tests := []struct {
+        name    string
+        steps   []testStep
+    }{
+        { "approve", withSetup(
+            pendingTrade,
+            testStep{ name: "approve", fn: "approveTransaction", args: []string{ LASTID }, caller: "issuer",
+                check: all(expectTransaction("Approved", 5), expectOwner("alice", 500, 0), expectOwner("issuer", 500, 0),
+                    expectHolding("apple", "alice", 100, 0), expectHolding("apple", "issuer", 900, 0), expectLastEvent(EVENTTRADEAPPROVED)) },
+            testStep{ name: "approve again", fn: "approveTransaction", args: []string{ LASTID }, caller: "issuer", code: ERRNOTPENDING },
+        ) },
+        { "decline", withSetup(
+            pendingTrade,
+            testStep{ name: "decline", fn: "declineTransaction", args: []string{ LASTID }, caller: "issuer",
+                check: all(expectTransaction("Declined", 5), expectOwner("alice", 1000, 0), expectOwner("issuer", 0, 0),
+                    expectHolding("apple", "issuer", 1000, 0), expectLastEvent(EVENTTRADEDECLINED)) },
+            testStep{ name: "decline again", fn: "declineTransaction", args: []string{ LASTID }, caller: "issuer", code: ERRNOTPENDING },
+        ) },
+        { "the whole escrowed holding is sold", withSetup(
+            testStep{ name: "alice buys 10", fn: "transactAsset", args: []string{ "apple", "issuer", "alice", "10", "5", "FALSE" } },
+            testStep{ name: "alice sells 10 to bob pending", fn: "transactAsset", args: []string{ "apple", "alice", "bob", "10", "5", "TRUE" } },
+            testStep{ name: "approve", fn: "approveTransaction", args: []string{ LASTID }, caller: "issuer",
+                check: all(expectOwner("alice", 1000, 0), expectOwner("bob", 950, 0), expectHolding("apple", "alice", 0, 0), expectHolding("apple", "bob", 10, 0)) },
+        ) },
+        { "not the approver", withSetup(
+            pendingTrade,
+            testStep{ name: "alice approves", fn: "approveTransaction", args: []string{ LASTID }, caller: "alice", code: ERRNOTAPPROVER,
+                check: all(expectOwner("alice", 500, 500), expectHolding("apple", "issuer", 900, 100)) },
+            testStep{ name: "bob declines", fn: "declineTransaction", args: []string{ LASTID }, caller: "bob", code: ERRNOTAPPROVER,
+                check: all(expectOwner("alice", 500, 500), expectHolding("apple", "issuer", 900, 100)) },
+            testStep{ name: "approve without an owner id", fn: "approveTransaction", args: []string{ LASTID }, code: ERRNOTAPPROVER,
+                check: all(expectOwner("alice", 500, 500), expectHolding("apple", "issuer", 900, 100)) },
+            testStep{ name: "decline as an admin", fn: "declineTransaction", args: []string{ LASTID }, admin: true, code: ERRNOTAPPROVER,
+                check: all(expectOwner("alice", 500, 500), expectHolding("apple", "issuer", 900, 100)) },
+        ) },
+        { "approve a validated transaction", withSetup(
+            testStep{ name: "alice buys 10", fn: "transactAsset", args: []string{ "apple", "issuer", "alice", "10", "5", "FALSE" } },
+            testStep{ name: "approve", fn: "approveTransaction", args: []string{ LASTID }, caller: "issuer", code: ERRNOTPENDING },
+        ) },
+        { "unknown transaction", withSetup(
+            testStep{ name: "approve", fn: "approveTransaction", args: []string{ "unknown" }, caller: "issuer", code: ERRNOTFOUND },
+            testStep{ name: "decline", fn: "declineTransaction", args: []string{ "unknown" }, caller: "issuer", code: ERRNOTFOUND },
+        ) },
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            dcc, stub := newTestLedger(t)
+            runSteps(t, dcc, stub, test.steps)
+        })
+    }
+}
+
+
+// The API stand-in answers {"fx":{"rate":0.8}}; the asset gives a 10% discount when the rate meets the condition.
+func TestAPIDiscount(t *testing.T) {
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+        w.Write([]byte(`{"fx":{"rate":0.8}}`))
+    }))
+    defer server.Close()
+    contract := func(condition string, value string) (testStep) {
+        return testStep{ name: "set the contract", fn: "updateAsset",
+            args: []string{ "apple", "0", "url", server.URL, "keys", "fx,rate", "condition", condition, "value", value, "discount", "10" } }
+    }
+    tests := []struct {
+        name    string
+        steps   []testStep
+    }{
+        { "less applies", withSetup(
+            contract("less", "1"),
+            testStep{ name: "alice buys 10", fn: "transactAsset", args: []string{ "apple", "issuer", "alice", "10", "5", "FALSE" },
+                check: all(expectTransaction("Validated", 4.5), expectOwner("alice", 955, 0), expectOwner("issuer", 45, 0)) },
+        ) },
+        { "more does not apply", withSetup(
+            contract("more", "1"),
+            testStep{ name: "alice buys 10", fn: "transactAsset", args: []string{ "apple", "issuer", "alice", "10", "5", "FALSE" },
+                check: all(expectTransaction("Validated", 5), expectOwner("alice", 950, 0), expectOwner("issuer", 50, 0)) },
+        ) },
+        { "equal applies", withSetup(
+            contract("equal", "0.8"),
+            testStep{ name: "alice buys 10", fn: "transactAsset", args: []string{ "apple", "issuer", "alice", "10", "5", "FALSE" },
+                check: expectTransaction("Validated", 4.5) },
+        ) },
+        { "discounted pending trade approved", withSetup(
+            contract("less", "1"),
+            testStep{ name: "alice buys 100", fn: "transactAsset", args: []string{ "apple", "issuer", "alice", "100", "5", "FALSE" },
+                check: all(expectTransaction("Pending", 4.5), expectOwner("alice", 550, 450)) },
+            testStep{ name: "approve", fn: "approveTransaction", args: []string{ LASTID }, caller: "issuer",
+                check: all(expectOwner("alice", 550, 0), expectOwner("issuer", 450, 0)) },
+        ) },
+        { "discount above 100", withSetup(
+            testStep{ name: "set the contract", fn: "updateAsset", args: []string{ "apple", "0", "url", server.URL, "keys", "fx,rate", "condition", "less", "value", "1", "discount", "150" },
+                code: ERRINVALIDARGUMENTS },
+            testStep{ name: "alice buys 10", fn: "transactAsset", args: []string{ "apple", "issuer", "alice", "10", "5", "FALSE" },
+                check: all(expectTransaction("Validated", 5), expectOwner("alice", 950, 0)) },
+        ) },
+        { "negative discount", withSetup(
+            testStep{ name: "set the discount", fn: "updateAsset", args: []string{ "apple", "0", "discount", "-10" }, code: ERRINVALIDARGUMENTS },
+        ) },
+        { "discount above 100 from JSON", withSetup(
+            testStep{ name: "set the discount", fn: "updateAssetJSON", args: []string{ `{"assetId":"apple","version":0,"apiTrigger":{"discount":150}}` }, code: ERRINVALIDARGUMENTS },
+        ) },
+        { "discounted pending trade declined", withSetup(
+            contract("less", "1"),
+            testStep{ name: "alice buys 100", fn: "transactAsset", args: []string{ "apple", "issuer", "alice", "100", "5", "FALSE" } },
+            testStep{ name: "decline", fn: "declineTransaction", args: []string{ LASTID }, caller: "issuer",
+                check: all(expectOwner("alice", 1000, 0), expectOwner("issuer", 0, 0)) },
+        ) },
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            dcc, stub := newTestLedger(t)
+            runSteps(t, dcc, stub, test.steps)
+        })
+    }
+}
+
+
+func expectMarketStats(assetId string, volume int, volume24h int) (func(*testing.T, *mockStub, InvokeResult)) {
+    return func(t *testing.T, stub *mockStub, result InvokeResult) {
+        statsBytes, err := new(DecodedChainCode).Query(stub, "readMarketStats", []string{ assetId })
+        if err != nil {
+            t.Fatalf("readMarketStats: %v", err)
+        }
+        var stats MarketStats
+        if err = json.Unmarshal(statsBytes, &stats); err != nil {
+            t.Fatalf("readMarketStats: invalid result %s", string(statsBytes))
+        }
+        if stats.Volume != volume || stats.Volume24h != volume24h || (volume24h > 0 && stats.VWAP24h != 5) {
+            t.Fatalf("expected a volume of %d, %d in 24 hours at 5, got %s", volume, volume24h, string(statsBytes))
+        }
+    }
+}
+
+
+// Moves the creation of a transaction back in time, as if it had been pending since.
+func backdateTransaction(t *testing.T, stub *mockStub, transactionId string, age int64) {
+    transaction, err := new(DecodedChainCode).getTransaction(stub, []string{ transactionId })
+    if err != nil {
+        t.Fatalf("getTransaction: %v", err)
+    }
+    transaction.Created = transaction.Created - age
+    if err = transaction.save(stub); err != nil {
+        t.Fatalf("save: %v", err)
+    }
+}
+
+
+func TestMarketData(t *testing.T) {
+    trade := func(buyerId string, quantity string) (testStep) {
+        return testStep{ name: buyerId + " buys " + quantity, fn: "transactAsset", args: []string{ "apple", "issuer", buyerId, quantity, "5", "FALSE" } }
+    }
+    t.Run("trades in the window", func(t *testing.T) {
+        dcc, stub := newTestLedger(t)
+        runSteps(t, dcc, stub, withSetup(trade("alice", "10"), trade("bob", "20")))
+        expectMarketStats("apple", 30, 30)(t, stub, InvokeResult{})
+    })
+    t.Run("buckets that left the window", func(t *testing.T) {
+        dcc, stub := newTestLedger(t)
+        expiredKey := windowKey("apple", 1000 * STATSBUCKET)
+        stub.state[expiredKey], _ = json.Marshal(WindowBucket{ Start: 1000 * STATSBUCKET, Volume: 7, Notional: 35 })
+        runSteps(t, dcc, stub, withSetup(trade("alice", "10")))
+        if _, ok := stub.state[expiredKey]; ok {
+            t.Fatalf("expected the expired bucket to be deleted")
+        }
+        expectMarketStats("apple", 10, 10)(t, stub, InvokeResult{})
+    })
+    t.Run("approved after a day", func(t *testing.T) {
+        dcc, stub := newTestLedger(t)
+        runSteps(t, dcc, stub, withSetup(trade("alice", "100")))
+        pending, err := dcc.getDataArrayStrings(stub, PRIMARYKEY[3], []string{})
+        if err != nil || len(pending) != 1 {
+            t.Fatalf("expected one pending transaction, got %v (%v)", pending, err)
+        }
+        backdateTransaction(t, stub, pending[0], 2 * STATSWINDOW)
+        runSteps(t, dcc, stub, []testStep{
+            { name: "approve", fn: "approveTransaction", args: pending, caller: "issuer", check: expectMarketStats("apple", 100, 0) },
+        })
+        transaction, _ := dcc.getTransaction(stub, pending)
+        start := transaction.Created - transaction.Created % 86400
+        if _, ok := stub.state[candleKey("apple", 86400, start)]; ok == false {
+            t.Fatalf("expected the trade in the daily candle of its creation")
+        }
+    })
+    t.Run("approved out of order", func(t *testing.T) {
+        dcc, stub := newTestLedger(t)
+        runSteps(t, dcc, stub, withSetup(trade("alice", "100"), trade("bob", "100")))
+        pending, err := dcc.getDataArrayStrings(stub, PRIMARYKEY[3], []string{})
+        if err != nil || len(pending) != 2 {
+            t.Fatalf("expected two pending transactions, got %v (%v)", pending, err)
+        }
+        // The first trade is made at 100s into the previous hour, the second at 200s.
+        now := time.Now().Unix()
+        hour := now - now % 3600 - 3600
+        for i, transactionId := range pending {
+            transaction, _ := dcc.getTransaction(stub, []string{ transactionId })
+            backdateTransaction(t, stub, transactionId, transaction.Created - (hour + int64(100 * (i + 1))))
+        }
+        runSteps(t, dcc, stub, []testStep{
+            { name: "approve the newer", fn: "approveTransaction", args: []string{ pending[1] }, caller: "issuer" },
+            { name: "approve the older", fn: "approveTransaction", args: []string{ pending[0] }, caller: "issuer", check: expectMarketStats("apple", 200, 200) },
+        })
+        stats, _ := dcc.getMarketStats(stub, "apple")
+        if stats.LastTradeTS != hour + 200 {
+            t.Fatalf("expected the last trade at %d, got %d", hour + 200, stats.LastTradeTS)
+        }
+        var candle Candle
+        if err = json.Unmarshal(stub.state[candleKey("apple", 3600, hour)], &candle); err != nil {
+            t.Fatalf("hourly candle: %v", err)
+        }
+        if candle.OpenedAt != hour + 100 || candle.ClosedAt != hour + 200 || candle.Volume != 200 {
+            t.Fatalf("expected the candle opened at %d and closed at %d, got %+v", hour + 100, hour + 200, candle)
+        }
+    })
+    t.Run("recent trades of an older schema", func(t *testing.T) {
+        dcc, stub := newTestLedger(t)
+        runSteps(t, dcc, stub, withSetup(trade("alice", "10")))
+        now := time.Now().Unix()
+        legacy := map[string]interface{}{ "assetId": "apple", "lastPrice": 5, "lastTradeAt": now, "volume": 40, "notional": 200, "vwap": 5,
+            "recentTrades": []Trade{ { Price: 5, Quantity: 30, Timestamp: now - 2 * STATSWINDOW }, { Price: 5, Quantity: 10, Timestamp: now } } }
+        stub.state[marketStatsKey("apple")], _ = json.Marshal(legacy)
+        for key := range stub.state {
+            if strings.HasPrefix(key, ENTITYPREFIX["window"]) {
+                delete(stub.state, key)
+            }
+        }
+        stub.state[systemKey(SCHEMAVERSIONKEY)] = []byte(strconv.Itoa(latestSchemaVersion() - 1))
+        if _, err := dcc.Init(stub, "init", []string{}); err != nil {
+            t.Fatalf("Init: %v", err)
+        }
+        expectMarketStats("apple", 40, 10)(t, stub, InvokeResult{})
+        if strings.Contains(string(stub.state[marketStatsKey("apple")]), "recentTrades") {
+            t.Fatalf("expected the recent trades to be dropped, got %s", string(stub.state[marketStatsKey("apple")]))
+        }
+    })
+    t.Run("negative candle range", func(t *testing.T) {
+        dcc, stub := newTestLedger(t)
+        runSteps(t, dcc, stub, withSetup(trade("alice", "10")))
+        for _, args := range [][]string{ { "apple", "60", "-60", "0" }, { "apple", "60", "0", "-1" } } {
+            _, err := dcc.Query(stub, "readCandles", args)
+            if chaincodeErr, ok := err.(*ChaincodeError); ok == false || chaincodeErr.Code != ERRINVALIDARGUMENTS {
+                t.Fatalf("readCandles %v: expected INVALID_ARGUMENTS, got %v", args, err)
+            }
+        }
+        candlesBytes, err := dcc.Query(stub, "readCandles", []string{ "apple", "60", "0", strconv.FormatInt(time.Now().Unix() + 60, 10) })
+        var candles []Candle
+        if err != nil || json.Unmarshal(candlesBytes, &candles) != nil || len(candles) != 1 {
+            t.Fatalf("readCandles: expected one candle, got %s (%v)", string(candlesBytes), err)
+        }
+    })
+}
+
+
+// ============================================================================================================================
@@ -0,0 +1,115 @@
+/*
+
+DECODED HYPERLEDGER APPLICATION
+
+Every error the chaincode returns is a ChaincodeError, serialised as the same JSON envelope:
+
+    {"Code":"INSUFFICIENT_BALANCE", "Error":"Insufficient balance", "Function":"transactAsset", "Details":{"ownerId":"bc"}}
+
+Clients branch on the code, which never changes for the same condition; the message is for people and can change.
+Errors from the ledger itself (state reads and writes, serialisation) reach the caller as INTERNAL_ERROR.
+
+Functions:
+- newChaincodeError
+- argumentCountError
+- toChaincodeError
+
+ChaincodeError functions:
+- Error
+- withDetail
+
+*/
+
+
+package main
+
+
+import (
+    "encoding/json"
+)
+
+
+// ============================================================================================================================
+
+
+// Error codes.
+const (
+    ERRINVALIDARGUMENTS     = "INVALID_ARGUMENTS"
+    ERRUNKNOWNFUNCTION      = "UNKNOWN_FUNCTION"
+    ERRNOTADMIN             = "NOT_ADMIN"
+    ERRLEDGERNOTEMPTY       = "LEDGER_NOT_EMPTY"
+    ERRSCHEMAVERSION        = "SCHEMA_VERSION_UNSUPPORTED"
+    ERRINVARIANTSVIOLATED   = "INVARIANTS_VIOLATED"
+    ERRNOTFOUND             = "NOT_FOUND"
+    ERROWNEREXISTS          = "OWNER_EXISTS"
+    ERRASSETEXISTS          = "ASSET_EXISTS"
+    ERRNOTVALIDATED         = "NOT_VALIDATED"
+    ERRVALIDATIONEXPIRED    = "VALIDATION_EXPIRED"
+    ERROWNERFROZEN          = "OWNER_FROZEN"
+    ERROWNERCLOSED          = "OWNER_CLOSED"
+    ERROWNERNOTEMPTY        = "OWNER_NOT_EMPTY"
+    ERRINSUFFICIENTBALANCE  = "INSUFFICIENT_BALANCE"
+    ERRINSUFFICIENTHOLDINGS = "INSUFFICIENT_HOLDINGS"
+    ERROWNERSHIPMISMATCH    = "OWNERSHIP_MISMATCH"
+    ERRPRICEMISMATCH        = "PRICE_MISMATCH"
+    ERRTRADINGHALTED        = "TRADING_HALTED"
+    ERRNOTPENDING           = "NOT_PENDING"
+    ERRNOTAPPROVER          = "NOT_APPROVER"
+    ERRVERSIONCONFLICT      = "VERSION_CONFLICT"
+    ERRORACLEFAILURE        = "ORACLE_FAILURE"
+    ERRINTERNAL             = "INTERNAL_ERROR"
+)
+
+
+type ChaincodeError struct {
+    Code        string              `json:"Code"`
+    Message     string              `json:"Error"`
+    Function    string              `json:"Function"`
+    Details     map[string]string   `json:"Details,omitempty"`
+}
+
+
+// ============================================================================================================================
+
+
+func newChaincodeError(code string, fn string, message string) (*ChaincodeError) {
+    return &ChaincodeError{ Code: code, Message: message, Function: fn }
+}
+
+
+func argumentCountError(fn string) (*ChaincodeError) {
+    return newChaincodeError(ERRINVALIDARGUMENTS, fn, "Incorrect number of arguments")
+}
+
+
+// Errors that are not chaincode errors yet are wrapped as INTERNAL_ERROR.
+func toChaincodeError(fn string, err error) (*ChaincodeError) {
+    if chaincodeErr, ok := err.(*ChaincodeError); ok {
+        return chaincodeErr
+    }
+    return newChaincodeError(ERRINTERNAL, fn, err.Error())
+}
+
+
+// ============================================================================================================================
+
+
+func (e *ChaincodeError) Error() (string) {
+    errorBytes, err := json.Marshal(e)
+    if err != nil {
+        return "{\"Code\":\"" + e.Code + "\", \"Error\":\"" + e.Message + "\", \"Function\":\"" + e.Function + "\"}"
+    }
+    return string(errorBytes)
+} // end of e.Error
+
+
+func (e *ChaincodeError) withDetail(key string, value string) (*ChaincodeError) {
+    if e.Details == nil {
+        e.Details = make(map[string]string)
+    }
+    e.Details[key] = value
+    return e
+} // end of e.withDetail
+
+
+// ============================================================================================================================
@@ -0,0 +1,132 @@
+/*
+
+DECODED HYPERLEDGER APPLICATION
+
+Chaincode events. Handlers record what they changed and every successful invoke sets a single event that
+summarises all of it, so off-chain services do not have to poll the ledgers. Init does the same on deploy and upgrade:
+
+    {"version":1, "function":"transactAsset", "timestamp":1483228800, "events":[{"type":"TRADE_PENDING", "id":"...", "details":{...}}]}
+
+The payload carries EVENTSCHEMAVERSION. Fields are only added within a version; renaming or removing one bumps it.
+Invokes that change nothing (for example freezing a frozen owner) set no event.
+
+Functions:
+- recordEvent
+- changedFields
+
+eventStub functions:
+- emit
+
+*/
+
+
+package main
+
+
+import (
+    "encoding/json"
+    "sort"
+    "strings"
+    "time"
+
+    "github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+
+// ============================================================================================================================
+
+
+// The name every event is set under.
+const EVENTNAME = "marketplace"
+const EVENTSCHEMAVERSION = 1
+
+// Event types.
+const (
+    EVENTLEDGERINITIALISED      = "LEDGER_INITIALISED"
+    EVENTLEDGERRESET            = "LEDGER_RESET"
+    EVENTLEDGERIMPORTED         = "LEDGER_IMPORTED"
+    EVENTSCHEMAMIGRATED         = "SCHEMA_MIGRATED"
+    EVENTOWNERCREATED           = "OWNER_CREATED"
+    EVENTOWNERUPDATED           = "OWNER_UPDATED"
+    EVENTOWNERVALIDATED         = "OWNER_VALIDATED"
+    EVENTOWNERVALIDATIONREVOKED = "OWNER_VALIDATION_REVOKED"
+    EVENTOWNERFROZEN            = "OWNER_FROZEN"
+    EVENTOWNERUNFROZEN          = "OWNER_UNFROZEN"
+    EVENTOWNERCLOSED            = "OWNER_CLOSED"
+    EVENTASSETISSUED            = "ASSET_ISSUED"
+    EVENTASSETUPDATED           = "ASSET_UPDATED"
+    EVENTTRADEVALIDATED         = "TRADE_VALIDATED"
+    EVENTTRADEPENDING           = "TRADE_PENDING"
+    EVENTTRADEAPPROVED          = "TRADE_APPROVED"
+    EVENTTRADEDECLINED          = "TRADE_DECLINED"
+    EVENTTRADINGHALTED          = "TRADING_HALTED"
+    EVENTTRADINGRESUMED         = "TRADING_RESUMED"
+    EVENTASSETTRADINGHALTED     = "ASSET_TRADING_HALTED"
+    EVENTASSETTRADINGRESUMED    = "ASSET_TRADING_RESUMED"
+    EVENTSTATEKEYSMIGRATED      = "STATE_KEYS_MIGRATED"
+    EVENTCOSTBASISMETHODSET     = "COST_BASIS_METHOD_SET"
+    EVENTCANDLEINTERVALSSET     = "CANDLE_INTERVALS_SET"
+    EVENTOWNERSHIPRECONCILED    = "OWNERSHIP_RECONCILED"
+)
+
+
+type Event struct {
+    Type        string              `json:"type"`
+    Id          string              `json:"id"` // The owner, asset or transaction the event is about, empty for marketplace-wide events.
+    Details     map[string]string   `json:"details,omitempty"`
+}
+
+
+type EventPayload struct {
+    Version     int                 `json:"version"`
+    Function    string              `json:"function"`
+    Timestamp   int64               `json:"timestamp"`
+    Events      []Event             `json:"events"`
+}
+
+
+// Collects the events recorded during an invoke or Init.
+type eventStub struct {
+    shim.ChaincodeStubInterface
+    events      []Event
+}
+
+
+// ============================================================================================================================
+
+
+// Records an event on the stub of the invoke. Nothing is recorded outside Init and Invoke, for example in a query.
+func recordEvent(stub shim.ChaincodeStubInterface, eventType string, id string, details map[string]string) {
+    if es, ok := stub.(*eventStub); ok {
+        es.events = append(es.events, Event{ Type: eventType, Id: id, Details: details })
+    }
+}
+
+
+// Lists the names of the changed fields, sorted and comma-separated.
+func changedFields(fields map[string]string) (string) {
+    names := []string{}
+    for name := range fields {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return strings.Join(names, ",")
+}
+
+
+// Sets the summary event of the invoke, if anything was recorded.
+func (es *eventStub) emit(fn string) (error) {
+    var err error
+    if len(es.events) == 0 {
+        return nil
+    }
+    payload := EventPayload{ Version: EVENTSCHEMAVERSION, Function: fn, Timestamp: time.Now().Unix(), Events: es.events }
+    payloadBytes, err := json.Marshal(&payload)
+    if err != nil {
+        return err
+    }
+    return es.ChaincodeStubInterface.SetEvent(EVENTNAME, payloadBytes)
+} // end of es.emit
+
+
+// ============================================================================================================================
@@ -0,0 +1,287 @@
+/*
+
+DECODED HYPERLEDGER APPLICATION
+
+Trading halts (circuit breakers):
+    - Global: no asset can be traded, approved or declined.
+    - Per asset: only the given asset is stopped.
+Halts are set and lifted by admins only and always carry a reason code.
+
+DecodedChainCode functions:
+- getTradingHalts - private function
+- verifyTradingActive - private function
+- createHalt - private function
+- haltTrading
+- resumeTrading
+- haltAssetTrading
+- resumeAssetTrading
+- readTradingHalts
+- readTradingStatus
+
+TradingHalts functions:
+- save
+- haltFor
+
+*/
+
+
+package main
+
+
+import (
+    "encoding/json"
+    "time"
+
+    "github.com/hyperledger/fabric/core/chaincode/shim"
+
+    utils "github.com/DecodedCo/blockchain-marketplace-chaincode/utils"
+)
+
+
+// ============================================================================================================================
+
+
+// The state key the halts are stored under.
+const HALTKEY = "TradingHalts"
+
+// Reason codes accepted when halting trading.
+var HALTREASONS = []string{ "ASSET_EVENT", "ORACLE_FAILURE", "MARKET_DISRUPTION", "REGULATORY", "MAINTENANCE", "OTHER" }
+
+
+type Halt struct {
+    Halted      bool                `json:"halted"`
+    ReasonCode  string              `json:"reasonCode"`
+    Reason      string              `json:"reason"`
+    Since       int64               `json:"since"`
+}
+
+
+type TradingHalts struct {
+    Global      Halt                `json:"global"`
+    Assets      map[string]Halt     `json:"assets"` // Only halted assets are listed.
+}
+
+
+type TradingStatus struct {
+    AssetId     string              `json:"assetId"`
+    Active      bool                `json:"tradingActive"`
+    Halt        Halt                `json:"halt"` // The halt in effect, global takes precedence.
+}
+
+
+// ============================================================================================================================
+
+
+func (th *TradingHalts) save(stub shim.ChaincodeStubInterface) (error) {
+    var err error
+    haltBytesToWrite, err := json.Marshal(&th)
+    if err != nil {
+        utils.PrintErrorFull("save - Marshal", err)
+        return err
+    }
+    if err = stub.PutState(systemKey(HALTKEY), haltBytesToWrite); err != nil {
+        utils.PrintErrorFull("save - PutState", err)
+        return err
+    }
+    return nil
+} // end of th.save
+
+
+// Returns the halt in effect for an asset. A global halt takes precedence.
+func (th *TradingHalts) haltFor(assetId string) (Halt) {
+    if th.Global.Halted {
+        return th.Global
+    }
+    return th.Assets[assetId]
+} // end of th.haltFor
+
+
+// ============================================================================================================================
+
+
+// Ledgers deployed before halts existed have no halt state, which means nothing is halted.
+func (dcc *DecodedChainCode) getTradingHalts(stub shim.ChaincodeStubInterface) (TradingHalts, error) {
+    var err error
+    halts := TradingHalts{ Assets: make(map[string]Halt) }
+    haltBytes, err := stub.GetState(systemKey(HALTKEY))
+    if err != nil {
+        utils.PrintErrorFull("getTradingHalts - GetState", err)
+        return halts, err
+    }
+    if haltBytes == nil {
+        return halts, nil
+    }
+    if err = json.Unmarshal(haltBytes, &halts); err != nil {
+        utils.PrintErrorFull("getTradingHalts - Unmarshal", err)
+        return halts, err
+    }
+    if halts.Assets == nil {
+        halts.Assets = make(map[string]Halt)
+    }
+    return halts, nil
+} // end of dcc.getTradingHalts
+
+
+// Returns an error if trading in the asset is halted, either globally or for the asset itself.
+func (dcc *DecodedChainCode) verifyTradingActive(stub shim.ChaincodeStubInterface, assetId string, fn string) (error) {
+    var err error
+    halts, err := dcc.getTradingHalts(stub)
+    if err != nil {
+        return err
+    }
+    if halts.Global.Halted {
+        err = newChaincodeError(ERRTRADINGHALTED, fn, "Trading is halted on the marketplace").withDetail("reasonCode", halts.Global.ReasonCode)
+        return err
+    }
+    if halts.Assets[assetId].Halted {
+        err = newChaincodeError(ERRTRADINGHALTED, fn, "Trading is halted for asset " + assetId).withDetail("assetId", assetId).withDetail("reasonCode", halts.Assets[assetId].ReasonCode)
+        return err
+    }
+    return nil
+} // end of dcc.verifyTradingActive
+
+
+func (dcc *DecodedChainCode) createHalt(fn string, reasonCode string, reason string) (Halt, error) {
+    var err error
+    var halt Halt
+    if utils.IsElementInSlice(HALTREASONS, reasonCode) == false {
+        err = newChaincodeError(ERRINVALIDARGUMENTS, fn, "Unknown halt reason code " + reasonCode).withDetail("reasonCode", "is not a known reason code")
+        utils.PrintErrorFull("", err)
+        return halt, err
+    }
+    halt = Halt{ Halted: true, ReasonCode: reasonCode, Reason: reason, Since: time.Now().Unix() }
+    return halt, nil
+} // end of dcc.createHalt
+
+
+func (dcc *DecodedChainCode) haltTrading(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
+    var err error
+    halts, err := dcc.getTradingHalts(stub)
+    if err != nil {
+        utils.PrintErrorFull("haltTrading - getTradingHalts", err)
+        return nil, err
+    }
+    halts.Global, err = dcc.createHalt(fn, args[0], args[1])
+    if err != nil {
+        utils.PrintErrorFull("haltTrading - createHalt", err)
+        return nil, err
+    }
+    if err = halts.save(stub); err != nil {
+        utils.PrintErrorFull("haltTrading - save", err)
+        return nil, err
+    }
+    recordEvent(stub, EVENTTRADINGHALTED, "", map[string]string{ "reasonCode": args[0], "reason": args[1] })
+    utils.PrintSuccess("Halted all trading: " + args[0])
+    result := newInvokeResult(fn, "", "Halted")
+    return result.toBytes()
+} // end of dcc.haltTrading
+
+
+func (dcc *DecodedChainCode) resumeTrading(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
+    var err error
+    halts, err := dcc.getTradingHalts(stub)
+    if err != nil {
+        utils.PrintErrorFull("resumeTrading - getTradingHalts", err)
+        return nil, err
+    }
+    // Asset specific halts stay in place.
+    halts.Global = Halt{}
+    if err = halts.save(stub); err != nil {
+        utils.PrintErrorFull("resumeTrading - save", err)
+        return nil, err
+    }
+    recordEvent(stub, EVENTTRADINGRESUMED, "", nil)
+    utils.PrintSuccess("Resumed trading on the marketplace")
+    result := newInvokeResult(fn, "", "Active")
+    return result.toBytes()
+} // end of dcc.resumeTrading
+
+
+func (dcc *DecodedChainCode) haltAssetTrading(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
+    var err error
+    assetId := args[0]
+    // Only existing assets can be halted.
+    if _, err = dcc.getAsset(stub, []string{ assetId }); err != nil {
+        utils.PrintErrorFull("haltAssetTrading - getAsset", err)
+        return nil, err
+    }
+    halts, err := dcc.getTradingHalts(stub)
+    if err != nil {
+        utils.PrintErrorFull("haltAssetTrading - getTradingHalts", err)
+        return nil, err
+    }
+    halt, err := dcc.createHalt(fn, args[1], args[2])
+    if err != nil {
+        utils.PrintErrorFull("haltAssetTrading - createHalt", err)
+        return nil, err
+    }
+    halts.Assets[assetId] = halt
+    if err = halts.save(stub); err != nil {
+        utils.PrintErrorFull("haltAssetTrading - save", err)
+        return nil, err
+    }
+    recordEvent(stub, EVENTASSETTRADINGHALTED, assetId, map[string]string{ "reasonCode": args[1], "reason": args[2] })
+    utils.PrintSuccess("Halted trading for asset `" + assetId + "`: " + args[1])
+    result := newInvokeResult(fn, assetId, "Halted")
+    return result.toBytes()
+} // end of dcc.haltAssetTrading
+
+
+func (dcc *DecodedChainCode) resumeAssetTrading(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
+    var err error
+    assetId := args[0]
+    halts, err := dcc.getTradingHalts(stub)
+    if err != nil {
+        utils.PrintErrorFull("resumeAssetTrading - getTradingHalts", err)
+        return nil, err
+    }
+    delete(halts.Assets, assetId)
+    if err = halts.save(stub); err != nil {
+        utils.PrintErrorFull("resumeAssetTrading - save", err)
+        return nil, err
+    }
+    recordEvent(stub, EVENTASSETTRADINGRESUMED, assetId, nil)
+    utils.PrintSuccess("Resumed trading for asset `" + assetId + "`")
+    result := newInvokeResult(fn, assetId, "Active")
+    return result.toBytes()
+} // end of dcc.resumeAssetTrading
+
+
+func (dcc *DecodedChainCode) readTradingHalts(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
+    var err error
+    halts, err := dcc.getTradingHalts(stub)
+    if err != nil {
+        utils.PrintErrorFull("readTradingHalts - getTradingHalts", err)
+        return nil, err
+    }
+    haltsBytes, err := json.Marshal(&halts)
+    if err != nil {
+        utils.PrintErrorFull("readTradingHalts - Marshal", err)
+        return nil, err
+    }
+    utils.PrintSuccess("Read the trading halts.")
+    return haltsBytes, nil
+} // end of dcc.readTradingHalts
+
+
+func (dcc *DecodedChainCode) readTradingStatus(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
+    var err error
+    assetId := args[0]
+    halts, err := dcc.getTradingHalts(stub)
+    if err != nil {
+        utils.PrintErrorFull("readTradingStatus - getTradingHalts", err)
+        return nil, err
+    }
+    halt := halts.haltFor(assetId)
+    status := TradingStatus{ AssetId: assetId, Active: !halt.Halted, Halt: halt }
+    statusBytes, err := json.Marshal(&status)
+    if err != nil {
+        utils.PrintErrorFull("readTradingStatus - Marshal", err)
+        return nil, err
+    }
+    utils.PrintSuccess("Read the trading status for asset `" + assetId + "`")
+    return statusBytes, nil
+} // end of dcc.readTradingStatus
+
+
+// ============================================================================================================================
@@ -0,0 +1,363 @@
+/*
+
+DECODED HYPERLEDGER APPLICATION
+
+Ledger invariants. The ledger is loaded once and checked by a pure function, so the same checks run on a live
+ledger (`checkInvariants`) and on data that is not in state yet.
+
+Rules:
+- MISSING_RECORD: an id in a ledger has no record.
+- UNKNOWN_OWNER: an asset or transaction refers to an owner that does not exist.
+- UNKNOWN_ASSET: an owner or transaction refers to an asset that does not exist.
+- UNKNOWN_TRANSACTION: an owner refers to a transaction that does not exist.
+- UNIT_CONSERVATION: the quantities and escrow quantities in OwnedBy do not add up to IssuedQty.
+- NEGATIVE_QUANTITY, NEGATIVE_BALANCE: a holding, escrow or balance is below zero.
+- ASSET_OWNERS: Asset.Owners and the owners in Asset.OwnedBy disagree.
+- OWNER_ASSETS: Owner.Assets and the holdings in Asset.OwnedBy disagree.
+- ISSUED_ASSETS: Owner.Issued and Asset.Issuer disagree.
+- ESCROW_QUANTITY: an escrow quantity is not the quantity of the seller's pending transactions in the asset.
+- ESCROW_BALANCE: an escrow balance is not the amount of the buyer's pending transactions.
+- PENDING_LEDGER: the PendingTransactions ledger and the pending transactions disagree.
+- OWNER_TRANSACTIONS: a transaction and the Transactions of its counterparties disagree.
+
+DecodedChainCode functions:
+- loadLedgerData - private function
+- checkInvariants
+
+Functions:
+- sortedKeys, formatAmount
+- verifyInvariants
+
+*/
+
+
+package main
+
+
+import (
+    "encoding/json"
+    "math"
+    "sort"
+    "strconv"
+
+    "github.com/hyperledger/fabric/core/chaincode/shim"
+
+    utils "github.com/DecodedCo/blockchain-marketplace-chaincode/utils"
+)
+
+
+// ============================================================================================================================
+
+
+// Balances are floats, differences below this are rounding.
+const BALANCETOLERANCE = 0.000001
+
+
+// Every record and ledger of the marketplace.
+type LedgerData struct {
+    Owners          map[string]Owner        `json:"owners"`
+    Assets          map[string]Asset        `json:"assets"`
+    Transactions    map[string]Transaction  `json:"transactions"`
+    Ledgers         map[string][]string     `json:"ledgers"`
+}
+
+
+type Violation struct {
+    Rule            string      `json:"rule"`
+    Entity          string      `json:"entity"`
+    Id              string      `json:"id"`
+    Detail          string      `json:"detail"`
+}
+
+
+type InvariantReport struct {
+    Valid           bool        `json:"valid"`
+    Violations      []Violation `json:"violations"`
+}
+
+
+// ============================================================================================================================
+
+
+func sortedKeys(records map[string]bool) ([]string) {
+    keys := []string{}
+    for key := range records {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+
+func formatAmount(amount float64) (string) {
+    return strconv.FormatFloat(amount, 'f', -1, 64)
+}
+
+
+// Returns every violation of the invariants, ordered by entity.
+func verifyInvariants(data LedgerData) ([]Violation) {
+    violations := []Violation{}
+    report := func(rule string, entity string, id string, detail string) {
+        violations = append(violations, Violation{ Rule: rule, Entity: entity, Id: id, Detail: detail })
+    }
+    // Ledger entries.
+    entities := map[string]string{ PRIMARYKEY[0]: "owner", PRIMARYKEY[1]: "asset", PRIMARYKEY[2]: "transaction", PRIMARYKEY[3]: "transaction" }
+    for _, ledgerName := range PRIMARYKEY {
+        for _, id := range data.Ledgers[ledgerName] {
+            found := false
+            switch entities[ledgerName] {
+                case "owner":
+                    _, found = data.Owners[id]
+                case "asset":
+                    _, found = data.Assets[id]
+                case "transaction":
+                    _, found = data.Transactions[id]
+            }
+            if found == false {
+                report("MISSING_RECORD", "ledger", ledgerName, "entry " + id + " has no record")
+            }
+        }
+    }
+    // What the pending transactions hold in escrow.
+    escrowQty := make(map[string]map[string]int) // assetId -> sellerId -> quantity
+    escrowAmount := make(map[string]float64) // buyerId -> amount
+    pending := make(map[string]bool)
+    transactionIds := make(map[string]bool)
+    for transactionId, transaction := range data.Transactions {
+        transactionIds[transactionId] = true
+        if transaction.Status != "Pending" {
+            continue
+        }
+        pending[transactionId] = true
+        if escrowQty[transaction.AssetId] == nil {
+            escrowQty[transaction.AssetId] = make(map[string]int)
+        }
+        escrowQty[transaction.AssetId][transaction.SellerId] = escrowQty[transaction.AssetId][transaction.SellerId] + transaction.Quantity
+        escrowAmount[transaction.BuyerId] = escrowAmount[transaction.BuyerId] + transaction.escrowedAmount()
+    }
+    // Assets
+    assetIds := make(map[string]bool)
+    for assetId := range data.Assets {
+        assetIds[assetId] = true
+    }
+    for _, assetId := range sortedKeys(assetIds) {
+        asset := data.Assets[assetId]
+        if _, ok := data.Owners[asset.Issuer]; ok == false {
+            report("UNKNOWN_OWNER", "asset", assetId, "issuer " + asset.Issuer + " does not exist")
+        } else if utils.IsElementInSlice(data.Owners[asset.Issuer].Issued, assetId) == false {
+            report("ISSUED_ASSETS", "asset", assetId, "issuer " + asset.Issuer + " does not list the asset as issued")
+        }
+        total := 0
+        holders := make(map[string]bool)
+        for ownerId := range asset.OwnedBy {
+            holders[ownerId] = true
+        }
+        for _, ownerId := range asset.Owners {
+            if holders[ownerId] == false {
+                report("ASSET_OWNERS", "asset", assetId, "owner " + ownerId + " is listed without a holding")
+            }
+        }
+        for _, ownerId := range sortedKeys(holders) {
+            ownedBy := asset.OwnedBy[ownerId]
+            total = total + ownedBy.Quantity + ownedBy.EscrowQty
+            if utils.IsElementInSlice(asset.Owners, ownerId) == false {
+                report("ASSET_OWNERS", "asset", assetId, "holder " + ownerId + " is not listed as an owner")
+            }
+            if ownedBy.Quantity < 0 || ownedBy.EscrowQty < 0 {
+                report("NEGATIVE_QUANTITY", "asset", assetId, "holder " + ownerId + " has quantity " + strconv.Itoa(ownedBy.Quantity) + " and escrow " + strconv.Itoa(ownedBy.EscrowQty))
+            }
+            if ownedBy.EscrowQty != escrowQty[assetId][ownerId] {
+                report("ESCROW_QUANTITY", "asset", assetId, "holder " + ownerId + " has " + strconv.Itoa(ownedBy.EscrowQty) + " in escrow, pending sales are " + strconv.Itoa(escrowQty[assetId][ownerId]))
+            }
+            owner, ok := data.Owners[ownerId]
+            if ok == false {
+                report("UNKNOWN_OWNER", "asset", assetId, "holder " + ownerId + " does not exist")
+                continue
+            }
+            if ownedBy.Quantity + ownedBy.EscrowQty > 0 && utils.IsElementInSlice(owner.Assets, assetId) == false {
+                report("OWNER_ASSETS", "owner", ownerId, "holds asset " + assetId + " but does not list it")
+            }
+        }
+        sellers := make(map[string]bool)
+        for sellerId := range escrowQty[assetId] {
+            sellers[sellerId] = true
+        }
+        for _, sellerId := range sortedKeys(sellers) {
+            if holders[sellerId] == false && escrowQty[assetId][sellerId] != 0 {
+                report("ESCROW_QUANTITY", "asset", assetId, "seller " + sellerId + " has pending sales of " + strconv.Itoa(escrowQty[assetId][sellerId]) + " but no holding")
+            }
+        }
+        if total != asset.IssuedQty {
+            report("UNIT_CONSERVATION", "asset", assetId, "holdings add up to " + strconv.Itoa(total) + ", issued " + strconv.Itoa(asset.IssuedQty))
+        }
+    }
+    // Owners
+    ownerIds := make(map[string]bool)
+    for ownerId := range data.Owners {
+        ownerIds[ownerId] = true
+    }
+    for _, ownerId := range sortedKeys(ownerIds) {
+        owner := data.Owners[ownerId]
+        if owner.Balance < -BALANCETOLERANCE || owner.EscrowBalance < -BALANCETOLERANCE {
+            report("NEGATIVE_BALANCE", "owner", ownerId, "balance " + formatAmount(owner.Balance) + ", escrow " + formatAmount(owner.EscrowBalance))
+        }
+        if math.Abs(owner.EscrowBalance - escrowAmount[ownerId]) > BALANCETOLERANCE {
+            report("ESCROW_BALANCE", "owner", ownerId, "escrow balance " + formatAmount(owner.EscrowBalance) + ", pending purchases " + formatAmount(escrowAmount[ownerId]))
+        }
+        for _, assetId := range owner.Assets {
+            asset, ok := data.Assets[assetId]
+            if ok == false {
+                report("UNKNOWN_ASSET", "owner", ownerId, "lists asset " + assetId + " that does not exist")
+                continue
+            }
+            ownedBy := asset.OwnedBy[ownerId]
+            if ownedBy.Quantity + ownedBy.EscrowQty <= 0 {
+                report("OWNER_ASSETS", "owner", ownerId, "lists asset " + assetId + " but holds none of it")
+            }
+        }
+        for _, assetId := range owner.Issued {
+            asset, ok := data.Assets[assetId]
+            if ok == false {
+                report("UNKNOWN_ASSET", "owner", ownerId, "lists issued asset " + assetId + " that does not exist")
+                continue
+            }
+            if asset.Issuer != ownerId {
+                report("ISSUED_ASSETS", "owner", ownerId, "lists asset " + assetId + " as issued, its issuer is " + asset.Issuer)
+            }
+        }
+        for _, transactionId := range owner.Transactions {
+            transaction, ok := data.Transactions[transactionId]
+            if ok == false {
+                report("UNKNOWN_TRANSACTION", "owner", ownerId, "lists transaction " + transactionId + " that does not exist")
+                continue
+            }
+            if transaction.BuyerId != ownerId && transaction.SellerId != ownerId {
+                report("OWNER_TRANSACTIONS", "owner", ownerId, "lists transaction " + transactionId + " it is not a counterparty of")
+            }
+        }
+    }
+    // Transactions
+    pendingLedger := make(map[string]bool)
+    for _, transactionId := range data.Ledgers[PRIMARYKEY[3]] {
+        pendingLedger[transactionId] = true
+        if transaction, ok := data.Transactions[transactionId]; ok && transaction.Status != "Pending" {
+            report("PENDING_LEDGER", "transaction", transactionId, "is in the pending ledger with status " + transaction.Status)
+        }
+    }
+    for _, transactionId := range sortedKeys(transactionIds) {
+        transaction := data.Transactions[transactionId]
+        if pending[transactionId] && pendingLedger[transactionId] == false {
+            report("PENDING_LEDGER", "transaction", transactionId, "is pending but not in the pending ledger")
+        }
+        if _, ok := data.Assets[transaction.AssetId]; ok == false {
+            report("UNKNOWN_ASSET", "transaction", transactionId, "asset " + transaction.AssetId + " does not exist")
+        }
+        for _, ownerId := range []string{ transaction.SellerId, transaction.BuyerId } {
+            owner, ok := data.Owners[ownerId]
+            if ok == false {
+                report("UNKNOWN_OWNER", "transaction", transactionId, "counterparty " + ownerId + " does not exist")
+                continue
+            }
+            if utils.IsElementInSlice(owner.Transactions, transactionId) == false {
+                report("OWNER_TRANSACTIONS", "transaction", transactionId, "counterparty " + ownerId + " does not list it")
+            }
+        }
+    }
+    return violations
+} // end of verifyInvariants
+
+
+// ============================================================================================================================
+
+
+// Loads every ledger and the records they list. Owners that are no longer in the Owners ledger (closed owners)
+// are loaded when an asset or transaction refers to them.
+func (dcc *DecodedChainCode) loadLedgerData(stub shim.ChaincodeStubInterface) (LedgerData, error) {
+    var err error
+    var emptyArgs []string
+    data := LedgerData{
+        Owners: make(map[string]Owner),
+        Assets: make(map[string]Asset),
+        Transactions: make(map[string]Transaction),
+        Ledgers: make(map[string][]string),
+    }
+    for _, ledgerName := range PRIMARYKEY {
+        data.Ledgers[ledgerName], err = dcc.getDataArrayStrings(stub, ledgerName, emptyArgs)
+        if err != nil {
+            return data, err
+        }
+    }
+    load := func(key string, v interface{}) (bool, error) {
+        recordBytes, err := stub.GetState(key)
+        if err != nil || recordBytes == nil {
+            return false, err
+        }
+        if err = json.Unmarshal(recordBytes, v); err != nil {
+            return false, err
+        }
+        return true, nil
+    }
+    referenced := []string{}
+    for _, assetId := range data.Ledgers[PRIMARYKEY[1]] {
+        var asset Asset
+        found, err := load(assetKey(assetId), &asset)
+        if err != nil {
+            return data, err
+        }
+        if found {
+            data.Assets[assetId] = asset
+            referenced = append(referenced, asset.Issuer)
+            referenced = append(referenced, asset.Owners...)
+        }
+    }
+    for _, ledgerName := range PRIMARYKEY[2:] {
+        for _, transactionId := range data.Ledgers[ledgerName] {
+            var transaction Transaction
+            found, err := load(transactionKey(transactionId), &transaction)
+            if err != nil {
+                return data, err
+            }
+            if found {
+                data.Transactions[transactionId] = transaction
+                referenced = append(referenced, transaction.SellerId, transaction.BuyerId)
+            }
+        }
+    }
+    for _, ownerId := range append(data.Ledgers[PRIMARYKEY[0]], referenced...) {
+        if _, ok := data.Owners[ownerId]; ok {
+            continue
+        }
+        var owner Owner
+        found, err := load(ownerKey(ownerId), &owner)
+        if err != nil {
+            return data, err
+        }
+        if found {
+            data.Owners[ownerId] = owner
+        }
+    }
+    return data, nil
+} // end of dcc.loadLedgerData
+
+
+// Returns every violation of the ledger invariants. The ledger is consistent when the list is empty.
+func (dcc *DecodedChainCode) checkInvariants(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
+    var err error
+    data, err := dcc.loadLedgerData(stub)
+    if err != nil {
+        utils.PrintErrorFull("checkInvariants - loadLedgerData", err)
+        return nil, err
+    }
+    violations := verifyInvariants(data)
+    report := InvariantReport{ Valid: len(violations) == 0, Violations: violations }
+    reportBytes, err := json.Marshal(&report)
+    if err != nil {
+        utils.PrintErrorFull("checkInvariants - Marshal", err)
+        return nil, err
+    }
+    utils.PrintSuccess("Checked the ledger invariants: " + strconv.Itoa(len(violations)) + " violations.")
+    return reportBytes, nil
+} // end of dcc.checkInvariants
+
+
+// ============================================================================================================================
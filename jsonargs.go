@@ -0,0 +1,402 @@
+/*
+
+DECODED HYPERLEDGER APPLICATION
+
+JSON-object variants of the positional create and update functions. Every function takes a single
+JSON-encoded argument, validates it and passes it on as positional arguments to the original function.
+Validation errors are reported per field:
+
+    {"Code":"INVALID_ARGUMENTS", "Error":"Invalid arguments", "Function":"addOwnerJSON", "Details":{"balance":"is required"}}
+
+DecodedChainCode functions:
+- decodeJSONFields - private function
+- decodeJSONArgument - private function
+- addOwnerJSON
+- addAssetJSON
+- updateOwnerJSON
+- updateAssetJSON
+- transactAssetJSON
+
+FieldErrors functions:
+- require
+- toError
+
+Other functions:
+- addPair - private function
+- jsonFieldIndex - private function
+
+*/
+
+
+package main
+
+
+import (
+    "bytes"
+    "encoding/json"
+    "io"
+    "reflect"
+    "strconv"
+    "strings"
+
+    "github.com/hyperledger/fabric/core/chaincode/shim"
+
+    utils "github.com/DecodedCo/blockchain-marketplace-chaincode/utils"
+)
+
+
+// ============================================================================================================================
+
+
+// Pointers are used for the fields so a missing field can be told apart from a zero value.
+
+
+type OwnerInput struct {
+    OwnerId         *string     `json:"ownerId"`
+    Name            *string     `json:"name"`
+    Balance         *float64    `json:"balance"`
+    Description     string      `json:"description"`
+    Logo            string      `json:"logo"`
+    Tag             string      `json:"tag"`
+}
+
+
+type AssetInput struct {
+    AssetId         *string     `json:"assetId"`
+    Name            *string     `json:"name"`
+    IssuerId        *string     `json:"issuerId"`
+    Quantity        *int        `json:"quantity"`
+    Price           *float64    `json:"price"`
+    Description     string      `json:"description"`
+    Logo            string      `json:"logo"`
+    Approval        bool        `json:"approval"`
+    ApprovalQty     int         `json:"approvalQty"`
+    Tag             string      `json:"tag"`
+}
+
+
+// Only the fields that are given are updated.
+type UpdateOwnerInput struct {
+    OwnerId         *string     `json:"ownerId"`
+    Version         *int        `json:"version"`
+    Name            *string     `json:"name"`
+    Tag             *string     `json:"tag"`
+    Description     *string     `json:"description"`
+    Logo            *string     `json:"logo"`
+    Background      *string     `json:"background"`
+}
+
+
+// Only the fields that are given are updated.
+type UpdateAssetInput struct {
+    AssetId         *string     `json:"assetId"`
+    Version         *int        `json:"version"`
+    Name            *string     `json:"name"`
+    Description     *string     `json:"description"`
+    Logo            *string     `json:"logo"`
+    Tag             *string     `json:"tag"`
+    Approval        *bool       `json:"approval"`
+    ApprovalQty     *int        `json:"approvalQty"`
+    Contract        *APIInput   `json:"apiTrigger"`
+}
+
+
+type APIInput struct {
+    URL             *string     `json:"url"`
+    Keys            []string    `json:"keys"`
+    Condition       *string     `json:"isBelow"`
+    Value           *string     `json:"value"`
+    Discount        *float64    `json:"discount"`
+}
+
+
+type TransactionInput struct {
+    AssetId         *string     `json:"assetId"`
+    SellerId        *string     `json:"sellerId"`
+    BuyerId         *string     `json:"buyerId"`
+    Quantity        *int        `json:"quantity"`
+    Price           *float64    `json:"price"`
+    Approval        bool        `json:"approvalRequired"`
+}
+
+
+// Maps a field name to what is wrong with it.
+type FieldErrors map[string]string
+
+
+// ============================================================================================================================
+
+
+// A field that already has an error, for example of the wrong type, keeps it.
+func (fe FieldErrors) require(field string, isPresent bool) {
+    if _, ok := fe[field]; isPresent == false && ok == false {
+        fe[field] = "is required"
+    }
+} // end of fe.require
+
+
+// Returns nil when there are no field errors.
+func (fe FieldErrors) toError(fn string) (error) {
+    if len(fe) == 0 {
+        return nil
+    }
+    chaincodeErr := newChaincodeError(ERRINVALIDARGUMENTS, fn, "Invalid arguments")
+    for field, problem := range fe {
+        chaincodeErr.withDetail(field, problem)
+    }
+    return chaincodeErr
+} // end of fe.toError
+
+
+// Appends the field and value to the positional update arguments if the field was given.
+func addPair(pairs []string, field string, value *string) ([]string) {
+    if value != nil {
+        pairs = append(pairs, field, *value)
+    }
+    return pairs
+} // end of addPair
+
+
+// ============================================================================================================================
+
+
+// Maps the JSON names of the fields of a struct type to their index, the fields of embedded structs included.
+func jsonFieldIndex(structType reflect.Type) (map[string][]int) {
+    fields := make(map[string][]int)
+    for i := 0; i < structType.NumField(); i++ {
+        field := structType.Field(i)
+        name := strings.Split(field.Tag.Get("json"), ",")[0]
+        if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+            for embeddedName, index := range jsonFieldIndex(field.Type) {
+                fields[embeddedName] = append([]int{ i }, index...)
+            }
+            continue
+        }
+        if field.PkgPath != "" || name == "-" {
+            continue
+        }
+        if name == "" {
+            name = field.Name
+        }
+        fields[name] = []int{ i }
+    }
+    return fields
+} // end of jsonFieldIndex
+
+
+// Decodes the single JSON object argument into v, a pointer to a struct. Every unknown field and every field of
+// the wrong type is returned as a field error, the other fields are decoded. An argument that is not one JSON
+// object is an error.
+func (dcc *DecodedChainCode) decodeJSONFields(fn string, args []string, v interface{}) (FieldErrors, error) {
+    var err error
+    fieldErrors := FieldErrors{}
+    if len(args) != 1 { // Only needs the JSON object.
+        err = argumentCountError(fn)
+        return fieldErrors, err
+    }
+    var fields map[string]json.RawMessage
+    decoder := json.NewDecoder(strings.NewReader(args[0]))
+    if err = decoder.Decode(&fields); err != nil || fields == nil {
+        err = newChaincodeError(ERRINVALIDARGUMENTS, fn, "Argument is not a valid JSON object")
+        return fieldErrors, err
+    }
+    if _, err = decoder.Token(); err != io.EOF {
+        err = newChaincodeError(ERRINVALIDARGUMENTS, fn, "Argument has data after the JSON object")
+        return fieldErrors, err
+    }
+    target := reflect.ValueOf(v).Elem()
+    index := jsonFieldIndex(target.Type())
+    for name, raw := range fields {
+        fieldIndex, ok := index[name]
+        if ok == false {
+            fieldErrors[name] = "is not a known field"
+            continue
+        }
+        field := target.FieldByIndex(fieldIndex)
+        // Nested objects are strict too.
+        fieldDecoder := json.NewDecoder(bytes.NewReader(raw))
+        fieldDecoder.DisallowUnknownFields()
+        if err = fieldDecoder.Decode(field.Addr().Interface()); err != nil {
+            if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+                fieldErrors[name] = "must be of type " + typeErr.Type.String()
+            } else if strings.HasPrefix(err.Error(), "json: unknown field ") {
+                fieldErrors[name] = "has an unknown field " + strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), "\"")
+            } else {
+                fieldErrors[name] = "is not valid"
+            }
+        }
+    }
+    return fieldErrors, nil
+} // end of dcc.decodeJSONFields
+
+
+// Decodes the single JSON object argument into v. All the field errors are returned together.
+func (dcc *DecodedChainCode) decodeJSONArgument(fn string, args []string, v interface{}) (error) {
+    fieldErrors, err := dcc.decodeJSONFields(fn, args, v)
+    if err != nil {
+        return err
+    }
+    return fieldErrors.toError(fn)
+} // end of dcc.decodeJSONArgument
+
+
+func (dcc *DecodedChainCode) addOwnerJSON(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
+    var err error
+    var input OwnerInput
+    fieldErrors, err := dcc.decodeJSONFields(fn, args, &input)
+    if err != nil {
+        utils.PrintErrorFull("addOwnerJSON - decodeJSONFields", err)
+        return nil, err
+    }
+    fieldErrors.require("ownerId", input.OwnerId != nil && *input.OwnerId != "")
+    fieldErrors.require("name", input.Name != nil && *input.Name != "")
+    fieldErrors.require("balance", input.Balance != nil)
+    if err = fieldErrors.toError(fn); err != nil {
+        utils.PrintErrorFull("", err)
+        return nil, err
+    }
+    // Pass on to the positional function: OwnerId, fullname, balance, description, logo-url, tag
+    return dcc.addOwner(stub, fn, []string{
+        *input.OwnerId,
+        *input.Name,
+        strconv.FormatFloat(*input.Balance, 'f', -1, 64),
+        input.Description,
+        input.Logo,
+        input.Tag,
+    })
+} // end of dcc.addOwnerJSON
+
+
+func (dcc *DecodedChainCode) addAssetJSON(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
+    var err error
+    var input AssetInput
+    fieldErrors, err := dcc.decodeJSONFields(fn, args, &input)
+    if err != nil {
+        utils.PrintErrorFull("addAssetJSON - decodeJSONFields", err)
+        return nil, err
+    }
+    fieldErrors.require("assetId", input.AssetId != nil && *input.AssetId != "")
+    fieldErrors.require("name", input.Name != nil && *input.Name != "")
+    fieldErrors.require("issuerId", input.IssuerId != nil && *input.IssuerId != "")
+    fieldErrors.require("quantity", input.Quantity != nil)
+    fieldErrors.require("price", input.Price != nil)
+    if err = fieldErrors.toError(fn); err != nil {
+        utils.PrintErrorFull("", err)
+        return nil, err
+    }
+    // Pass on to the positional function: Id, Name, issuerId, Quantity, Price, description, logo, approval, approvalQty, tag
+    return dcc.addAssetString(stub, fn, []string{
+        *input.AssetId,
+        *input.Name,
+        *input.IssuerId,
+        strconv.Itoa(*input.Quantity),
+        strconv.FormatFloat(*input.Price, 'f', -1, 64),
+        input.Description,
+        input.Logo,
+        strconv.FormatBool(input.Approval),
+        strconv.Itoa(input.ApprovalQty),
+        input.Tag,
+    })
+} // end of dcc.addAssetJSON
+
+
+func (dcc *DecodedChainCode) updateOwnerJSON(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
+    var err error
+    var input UpdateOwnerInput
+    fieldErrors, err := dcc.decodeJSONFields(fn, args, &input)
+    if err != nil {
+        utils.PrintErrorFull("updateOwnerJSON - decodeJSONFields", err)
+        return nil, err
+    }
+    fieldErrors.require("ownerId", input.OwnerId != nil && *input.OwnerId != "")
+    fieldErrors.require("version", input.Version != nil)
+    if err = fieldErrors.toError(fn); err != nil {
+        utils.PrintErrorFull("", err)
+        return nil, err
+    }
+    // Pass on to the positional function: OwnerId, version, field, value, ...
+    positional := []string{ *input.OwnerId, strconv.Itoa(*input.Version) }
+    positional = addPair(positional, "name", input.Name)
+    positional = addPair(positional, "tag", input.Tag)
+    positional = addPair(positional, "description", input.Description)
+    positional = addPair(positional, "logo", input.Logo)
+    positional = addPair(positional, "background", input.Background)
+    return dcc.updateOwner(stub, fn, positional)
+} // end of dcc.updateOwnerJSON
+
+
+func (dcc *DecodedChainCode) updateAssetJSON(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
+    var err error
+    var input UpdateAssetInput
+    fieldErrors, err := dcc.decodeJSONFields(fn, args, &input)
+    if err != nil {
+        utils.PrintErrorFull("updateAssetJSON - decodeJSONFields", err)
+        return nil, err
+    }
+    fieldErrors.require("assetId", input.AssetId != nil && *input.AssetId != "")
+    fieldErrors.require("version", input.Version != nil)
+    if err = fieldErrors.toError(fn); err != nil {
+        utils.PrintErrorFull("", err)
+        return nil, err
+    }
+    // Pass on to the positional function: assetId, version, field, value, ...
+    positional := []string{ *input.AssetId, strconv.Itoa(*input.Version) }
+    positional = addPair(positional, "name", input.Name)
+    positional = addPair(positional, "description", input.Description)
+    positional = addPair(positional, "logo", input.Logo)
+    positional = addPair(positional, "tag", input.Tag)
+    if input.Approval != nil {
+        positional = append(positional, "approval", strconv.FormatBool(*input.Approval))
+    }
+    if input.ApprovalQty != nil {
+        positional = append(positional, "approvalQty", strconv.Itoa(*input.ApprovalQty))
+    }
+    if input.Contract != nil {
+        positional = addPair(positional, "url", input.Contract.URL)
+        if input.Contract.Keys != nil {
+            positional = append(positional, "keys", strings.Join(input.Contract.Keys, ","))
+        }
+        positional = addPair(positional, "condition", input.Contract.Condition)
+        positional = addPair(positional, "value", input.Contract.Value)
+        if input.Contract.Discount != nil {
+            positional = append(positional, "discount", strconv.FormatFloat(*input.Contract.Discount, 'f', -1, 64))
+        }
+    }
+    return dcc.updateAsset(stub, fn, positional)
+} // end of dcc.updateAssetJSON
+
+
+func (dcc *DecodedChainCode) transactAssetJSON(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
+    var err error
+    var input TransactionInput
+    fieldErrors, err := dcc.decodeJSONFields(fn, args, &input)
+    if err != nil {
+        utils.PrintErrorFull("transactAssetJSON - decodeJSONFields", err)
+        return nil, err
+    }
+    fieldErrors.require("assetId", input.AssetId != nil && *input.AssetId != "")
+    fieldErrors.require("sellerId", input.SellerId != nil && *input.SellerId != "")
+    fieldErrors.require("buyerId", input.BuyerId != nil && *input.BuyerId != "")
+    fieldErrors.require("quantity", input.Quantity != nil)
+    fieldErrors.require("price", input.Price != nil)
+    if err = fieldErrors.toError(fn); err != nil {
+        utils.PrintErrorFull("", err)
+        return nil, err
+    }
+    approvalRequired := "FALSE"
+    if input.Approval {
+        approvalRequired = "TRUE"
+    }
+    // Pass on to the positional function: assetId, sellerId, buyerId, quantity, price, approvalRequired
+    return dcc.transactAsset(stub, fn, []string{
+        *input.AssetId,
+        *input.SellerId,
+        *input.BuyerId,
+        strconv.Itoa(*input.Quantity),
+        strconv.FormatFloat(*input.Price, 'f', -1, 64),
+        approvalRequired,
+    })
+} // end of dcc.transactAssetJSON
+
+
+// ============================================================================================================================
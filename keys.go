@@ -0,0 +1,330 @@
+/*
+
+DECODED HYPERLEDGER APPLICATION
+
+State keys are namespaced by entity type so that ids of different entities can never collide:
+
+    owner:<ownerId>
+    asset:<assetId>
+    transaction:<transactionId>
+    ledger:<Owners|Assets|Transactions|PendingTransactions>:<id>
+    ledger:AssetTransactions:<assetId>:<transactionId>
+    position:<ownerId>
+    market:<assetId>
+    candle:<assetId>:<interval>:<start>
+    repair:<repairId>
+    system:<TradingHalts|CostBasisMethod|CandleIntervals|...>
+
+Owner and asset ids cannot contain the separator, see verifyId; transaction ids are hashes.
+
+Every ledger entry is a key of its own and a ledger is read with a range query over its prefix,
+so adding to a ledger never reads or rewrites the whole ledger.
+
+Ledgers deployed before the namespacing wrote every entity under its bare id and kept each ledger
+as a single JSON array. `migrateStateKeys` moves that state to the namespaced keys and entries. Init does the same
+as the first schema migration, see schema.go.
+
+Functions:
+- stateKey
+- verifyId
+- ownerKey, assetKey, transactionKey, ledgerKey, systemKey, positionKey
+- ledgerEntryPrefix, ledgerEntryKey
+- prefixRange
+
+DecodedChainCode functions:
+- moveLegacyRecord - private function
+- moveLegacyState - private function
+- migrateStateKeys
+
+*/
+
+
+package main
+
+
+import (
+    "encoding/json"
+    "strconv"
+    "strings"
+
+    "github.com/hyperledger/fabric/core/chaincode/shim"
+
+    utils "github.com/DecodedCo/blockchain-marketplace-chaincode/utils"
+)
+
+
+// ============================================================================================================================
+
+
+// Separates the parts of a state key. Ids cannot contain it, so the key range of one id never covers another.
+const KEYSEPARATOR = ":"
+
+// Entity types and the prefix of their state keys.
+var ENTITYPREFIX = map[string]string{
+    "owner": "owner:",
+    "asset": "asset:",
+    "transaction": "transaction:",
+    "ledger": "ledger:",
+    "system": "system:",
+    "position": "position:",
+    "market": "market:",
+    "candle": "candle:",
+    "window": "window:",
+    "repair": "repair:",
+}
+
+
+type KeyMigrationReport struct {
+    Moved       map[string]int      `json:"moved"` // Number of records moved per entity type.
+    Conflicts   []string            `json:"conflicts"` // Records that could not be moved.
+}
+
+
+// ============================================================================================================================
+
+
+// Returns the state key of an entity, or an error for an unknown entity type.
+func stateKey(entityType string, id string) (string, error) {
+    prefix, ok := ENTITYPREFIX[entityType]
+    if ok == false {
+        err := newChaincodeError(ERRINVALIDARGUMENTS, "stateKey", "Unknown entity type " + entityType).withDetail("entityType", "is not a known entity type")
+        return "", err
+    }
+    return prefix + id, nil
+}
+
+
+func ownerKey(ownerId string) (string) {
+    return ENTITYPREFIX["owner"] + ownerId
+}
+
+
+func assetKey(assetId string) (string) {
+    return ENTITYPREFIX["asset"] + assetId
+}
+
+
+func transactionKey(transactionId string) (string) {
+    return ENTITYPREFIX["transaction"] + transactionId
+}
+
+
+func ledgerKey(ledgerName string) (string) {
+    return ENTITYPREFIX["ledger"] + ledgerName
+}
+
+
+func systemKey(name string) (string) {
+    return ENTITYPREFIX["system"] + name
+}
+
+
+func positionKey(ownerId string) (string) {
+    return ENTITYPREFIX["position"] + ownerId
+}
+
+
+func ledgerEntryPrefix(ledgerName string) (string) {
+    return ledgerKey(ledgerName) + KEYSEPARATOR
+}
+
+
+func ledgerEntryKey(ledgerName string, id string) (string) {
+    return ledgerEntryPrefix(ledgerName) + id
+}
+
+
+// Owner and asset ids become part of composite keys, such as the ledger entries and candles.
+func verifyId(fn string, field string, id string) (error) {
+    if id == "" {
+        return newChaincodeError(ERRINVALIDARGUMENTS, fn, "Invalid arguments").withDetail(field, "must not be empty")
+    }
+    if strings.Contains(id, KEYSEPARATOR) {
+        return newChaincodeError(ERRINVALIDARGUMENTS, fn, "Invalid arguments").withDetail(field, "must not contain " + KEYSEPARATOR)
+    }
+    return nil
+}
+
+
+// Returns the start and end key of a range query that covers exactly the keys starting with the prefix.
+func prefixRange(prefix string) (string, string) {
+    last := prefix[len(prefix) - 1]
+    return prefix, prefix[:len(prefix) - 1] + string(last + 1)
+}
+
+
+// ============================================================================================================================
+
+
+// Moves the record stored under the bare id to its namespaced key and returns the record. The legacy record
+// is only moved if its identity field holds the id, otherwise another entity has overwritten it and it is reported.
+func (dcc *DecodedChainCode) moveLegacyRecord(stub shim.ChaincodeStubInterface, entityType string, id string, identityField string, report *KeyMigrationReport) ([]byte, error) {
+    var err error
+    newKey, err := stateKey(entityType, id)
+    if err != nil {
+        return nil, err
+    }
+    legacyBytes, err := stub.GetState(id)
+    if err != nil {
+        return nil, err
+    }
+    if legacyBytes != nil {
+        var record map[string]interface{}
+        if err = json.Unmarshal(legacyBytes, &record); err != nil || record[identityField] != id {
+            report.Conflicts = append(report.Conflicts, entityType + " " + id + ": the record under its id is not a " + entityType)
+            return nil, nil
+        }
+        if err = stub.PutState(newKey, legacyBytes); err != nil {
+            return nil, err
+        }
+        if err = stub.DelState(id); err != nil {
+            return nil, err
+        }
+        report.Moved[entityType] = report.Moved[entityType] + 1
+        return legacyBytes, nil
+    }
+    // Nothing to move. Either it has been moved before, or the record was lost.
+    newBytes, err := stub.GetState(newKey)
+    if err != nil {
+        return nil, err
+    }
+    if newBytes == nil {
+        report.Conflicts = append(report.Conflicts, entityType + " " + id + ": no record found")
+    }
+    return newBytes, nil
+} // end of dcc.moveLegacyRecord
+
+
+// Running it again after a successful migration changes nothing.
+func (dcc *DecodedChainCode) moveLegacyState(stub shim.ChaincodeStubInterface) (KeyMigrationReport, error) {
+    var err error
+    var emptyArgs []string
+    report := KeyMigrationReport{ Moved: make(map[string]int), Conflicts: []string{} }
+    // 1. Turn the JSON array ledgers into ledger entries, keeping their contents to find the records.
+    //    Depending on the deployed version the array is stored under the bare name or the namespaced name.
+    ledgers := make(map[string][]string)
+    for _, ledgerName := range PRIMARYKEY {
+        for _, arrayKey := range []string{ ledgerName, ledgerKey(ledgerName) } {
+            arrayBytes, err := stub.GetState(arrayKey)
+            if err != nil {
+                utils.PrintErrorFull("moveLegacyState - GetState", err)
+                return report, err
+            }
+            if arrayBytes == nil {
+                continue
+            }
+            var ids []string
+            if err = json.Unmarshal(arrayBytes, &ids); err != nil {
+                report.Conflicts = append(report.Conflicts, "ledger " + arrayKey + ": the record under its name is not a ledger")
+                continue
+            }
+            for _, id := range ids {
+                if err = dcc.addToLedger(stub, ledgerName, id); err != nil {
+                    utils.PrintErrorFull("moveLegacyState - addToLedger", err)
+                    return report, err
+                }
+                if utils.IsElementInSlice(ledgers[ledgerName], id) == false {
+                    ledgers[ledgerName] = append(ledgers[ledgerName], id)
+                }
+            }
+            if err = stub.DelState(arrayKey); err != nil {
+                utils.PrintErrorFull("moveLegacyState - DelState", err)
+                return report, err
+            }
+            report.Moved["ledger"] = report.Moved["ledger"] + 1
+        }
+        // Entries written by an earlier run.
+        entries, err := dcc.getDataArrayStrings(stub, ledgerName, emptyArgs)
+        if err != nil {
+            utils.PrintErrorFull("moveLegacyState - getDataArrayStrings", err)
+            return report, err
+        }
+        for _, id := range entries {
+            if utils.IsElementInSlice(ledgers[ledgerName], id) == false {
+                ledgers[ledgerName] = append(ledgers[ledgerName], id)
+            }
+        }
+    }
+    // 2. Transactions and assets. They also refer to owners that are no longer in the Owners ledger (closed owners).
+    ownerIds := ledgers[PRIMARYKEY[0]]
+    for _, transactionId := range ledgers[PRIMARYKEY[2]] {
+        transactionBytes, err := dcc.moveLegacyRecord(stub, "transaction", transactionId, "transactionId", &report)
+        if err != nil {
+            utils.PrintErrorFull("moveLegacyState - moveLegacyRecord", err)
+            return report, err
+        }
+        var transaction Transaction
+        if transactionBytes != nil && json.Unmarshal(transactionBytes, &transaction) == nil {
+            ownerIds = append(ownerIds, transaction.SellerId, transaction.BuyerId)
+            // Transactions from before the asset ledgers existed.
+            if err = dcc.addToLedger(stub, assetTransactionsLedger(transaction.AssetId), transactionId); err != nil {
+                utils.PrintErrorFull("moveLegacyState - addToLedger", err)
+                return report, err
+            }
+        }
+    }
+    for _, assetId := range ledgers[PRIMARYKEY[1]] {
+        assetBytes, err := dcc.moveLegacyRecord(stub, "asset", assetId, "assetId", &report)
+        if err != nil {
+            utils.PrintErrorFull("moveLegacyState - moveLegacyRecord", err)
+            return report, err
+        }
+        var asset Asset
+        if assetBytes != nil && json.Unmarshal(assetBytes, &asset) == nil {
+            ownerIds = append(ownerIds, asset.Issuer)
+            ownerIds = append(ownerIds, asset.Owners...)
+        }
+    }
+    // 3. Owners, each once.
+    var movedOwners []string
+    for _, ownerId := range ownerIds {
+        if utils.IsElementInSlice(movedOwners, ownerId) {
+            continue
+        }
+        movedOwners = append(movedOwners, ownerId)
+        if _, err = dcc.moveLegacyRecord(stub, "owner", ownerId, "username", &report); err != nil {
+            utils.PrintErrorFull("moveLegacyState - moveLegacyRecord", err)
+            return report, err
+        }
+    }
+    // 4. System state.
+    haltBytes, err := stub.GetState(HALTKEY)
+    if err != nil {
+        utils.PrintErrorFull("moveLegacyState - GetState", err)
+        return report, err
+    }
+    if haltBytes != nil {
+        if err = stub.PutState(systemKey(HALTKEY), haltBytes); err != nil {
+            utils.PrintErrorFull("moveLegacyState - PutState", err)
+            return report, err
+        }
+        if err = stub.DelState(HALTKEY); err != nil {
+            utils.PrintErrorFull("moveLegacyState - DelState", err)
+            return report, err
+        }
+        report.Moved["system"] = report.Moved["system"] + 1
+    }
+    return report, nil
+} // end of dcc.moveLegacyState
+
+
+// Admin function. Also run by Init as the first schema migration, see schema.go.
+func (dcc *DecodedChainCode) migrateStateKeys(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
+    var err error
+    report, err := dcc.moveLegacyState(stub)
+    if err != nil {
+        utils.PrintErrorFull("migrateStateKeys - moveLegacyState", err)
+        return nil, err
+    }
+    reportBytes, err := json.Marshal(&report)
+    if err != nil {
+        utils.PrintErrorFull("migrateStateKeys - Marshal", err)
+        return nil, err
+    }
+    recordEvent(stub, EVENTSTATEKEYSMIGRATED, "", map[string]string{ "conflicts": strconv.Itoa(len(report.Conflicts)) })
+    utils.PrintSuccess("Migrated the state to namespaced keys and ledger entries.")
+    return reportBytes, nil
+} // end of dcc.migrateStateKeys
+
+
+// ============================================================================================================================
@@ -4,11 +4,18 @@ DECODED HYPERLEDGER APPLICATION
 
 DecodedChainCode functions:
 - main, Init, Invoke, Query (standard and required)
-- read: reads the contents of a specific key.
+- initLedger - private function, the init of a deploy, an upgrade or an admin invoke.
+- invoke - private function, dispatches the invokes through the registry.
+- query - private function, dispatches the queries through the registry.
+- read: reads the contents of a specific entity, given its type and id.
 - readAll: reads all the primary keys.
 - getDataArrayStrings - private function
-- saveStringToDataArray
-- saveLedger
+- addToLedger
+- removeFromLedger
+- clearLedger
+- verifyAdmin - private function
+- parseFieldPairs - private function
+- verifyVersion - private function
 
 */
 
@@ -17,7 +24,7 @@ package main
 
 import (
     "encoding/json"
-    "errors"
+    "strconv"
 
     "github.com/hyperledger/fabric/core/chaincode/shim"
 
@@ -34,6 +41,13 @@ type DecodedChainCode struct {
 
 var PRIMARYKEY = [4]string{ "Owners", "Assets", "Transactions", "PendingTransactions" }
 
+// Certificate attribute and value that identify an admin caller.
+const ADMINATTRIBUTE = "role"
+const ADMINROLE = "admin"
+
+// Certificate attribute that carries the owner id of the caller.
+const OWNERATTRIBUTE = "ownerId"
+
 
 // ============================================================================================================================
 // Main
@@ -55,113 +69,139 @@ func main() {
 // ============================================================================================================================
 
 
-// Init resets all the things
+// Init runs on deploy and upgrade. The events it records are set as one event, as for Invoke.
 func (dcc *DecodedChainCode) Init(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
+    events := &eventStub{ ChaincodeStubInterface: stub }
+    result, err := dcc.initLedger(events, fn, args)
+    if err != nil {
+        return nil, toChaincodeError(fn, err)
+    }
+    if err = events.emit(fn); err != nil {
+        utils.PrintErrorFull("Init - emit", err)
+        return nil, toChaincodeError(fn, err)
+    }
+    return result, nil
+}
+
+
+// Sets up an empty ledger. A populated ledger is migrated to the latest schema when the chaincode is upgraded,
+// see schema.go, and only reset when an admin confirms it, see reset.go.
+func (dcc *DecodedChainCode) initLedger(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
     var err error
-    if len(args) != 0 {
-        err = errors.New("{\"Error\":\"Incorrect number of arguments\", \"Function\":\"" + fn + "\"}")
+    if len(args) > 1 { // [RESETCONFIRMATION]
+        err = argumentCountError(fn)
         utils.PrintErrorFull("", err)
         return nil, err
     }
-    // Initialise the empty datastores. The owners and assets datastores are going to store an array of all keys/ids.
-    var blank []string
-    blankBytes, err := json.Marshal(&blank)
+    version, err := dcc.getSchemaVersion(stub)
     if err != nil {
-        utils.PrintErrorFull("Init - Marshal", err)
+        utils.PrintErrorFull("initLedger - getSchemaVersion", err)
         return nil, err
     }
-    //
-    if err = stub.PutState(PRIMARYKEY[0], blankBytes); err != nil {
-        utils.PrintErrorFull("Init", err)
+    if version > latestSchemaVersion() {
+        err = newChaincodeError(ERRSCHEMAVERSION, fn, "The ledger follows schema version " + strconv.Itoa(version) + ", this chaincode only knows up to version " + strconv.Itoa(latestSchemaVersion())).withDetail("version", strconv.Itoa(version))
+        utils.PrintErrorFull("", err)
         return nil, err
     }
-    if err = stub.PutState(PRIMARYKEY[1], blankBytes); err != nil {
-        utils.PrintErrorFull("Init", err)
+    isEmpty, err := dcc.isLedgerEmpty(stub)
+    if err != nil {
+        utils.PrintErrorFull("initLedger - isLedgerEmpty", err)
         return nil, err
     }
-    if err = stub.PutState(PRIMARYKEY[2], blankBytes); err != nil {
-        utils.PrintErrorFull("Init", err)
-        return nil, err
+    if isEmpty == false {
+        migrated := version < latestSchemaVersion()
+        var report SchemaMigrationReport
+        if migrated {
+            if report, err = dcc.migrateSchema(stub, fn); err != nil {
+                utils.PrintErrorFull("initLedger - migrateSchema", err)
+                return nil, err
+            }
+        }
+        if len(args) == 0 || args[0] != RESETCONFIRMATION {
+            if migrated {
+                result := newInvokeResult(fn, "", "Migrated")
+                result.Migration = &report
+                return result.toBytes()
+            }
+            err = newChaincodeError(ERRLEDGERNOTEMPTY, fn, "The ledger holds records, an admin has to pass " + RESETCONFIRMATION + " to reset it")
+            utils.PrintErrorFull("", err)
+            return nil, err
+        }
+        if err = dcc.verifyAdmin(stub, fn); err != nil {
+            utils.PrintErrorFull("initLedger - verifyAdmin", err)
+            return nil, err
+        }
+        if _, err = dcc.resetLedger(stub, fn, args); err != nil {
+            utils.PrintErrorFull("initLedger - resetLedger", err)
+            return nil, err
+        }
     }
-    if err = stub.PutState(PRIMARYKEY[3], blankBytes); err != nil {
-        utils.PrintErrorFull("Init", err)
+    if err = dcc.setSchemaVersion(stub, latestSchemaVersion()); err != nil {
+        utils.PrintErrorFull("initLedger - setSchemaVersion", err)
         return nil, err
     }
+    recordEvent(stub, EVENTLEDGERINITIALISED, "", nil)
     // Done.
     utils.PrintSuccess("Initialisation complete")
-    return nil, nil
-} 
+    result := newInvokeResult(fn, "", "Initialised")
+    return result.toBytes()
+} // end of dcc.initLedger
 
 
-// Invoke is our entry point to invoke a chaincode function
+// Invoke is our entry point to invoke a chaincode function. The events the function records are set as one event.
 func (dcc *DecodedChainCode) Invoke(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
-    // Handle different functions
-    if fn == "init" { //initialize the chaincode state, used as reset
-        return dcc.Init(stub, fn, args)
-    } else if fn == "addOwner" {
-        return dcc.addOwner(stub, fn, args)
-    } else if fn == "addOwnerString" {
-        return dcc.addOwnerString(stub, fn, args)
-    } else if fn == "updateOwner" {
-        return dcc.updateOwner(stub, fn, args)
-    } else if fn == "changeOwnerValidationStatus" { // read all owners and return full data for them.
-        return dcc.changeOwnerValidationStatus(stub, fn, args)
-    } else if fn == "addAssetString" {
-        return dcc.addAssetString(stub, fn, args)
-    } else if fn == "updateAsset" {
-        return dcc.updateAsset(stub, fn, args)
-    } else if fn == "transactAsset" {
-        return dcc.transactAsset(stub, fn, args)
-    } else if fn == "approveTransaction" {
-        return dcc.approveTransaction(stub, fn, args)
-    } else if fn == "declineTransaction" {
-        return dcc.declineTransaction(stub, fn, args)
+    events := &eventStub{ ChaincodeStubInterface: stub }
+    result, err := dcc.invoke(events, fn, args)
+    if err != nil {
+        return nil, toChaincodeError(fn, err)
     }
-    // In any other case.
-    utils.PrintError("ERROR: Invoke function did not find ChainCode function: " + fn)
-    return nil, errors.New(" --- INVOKE ERROR: Received unknown function invocation")
+    if err = events.emit(fn); err != nil {
+        utils.PrintErrorFull("Invoke - emit", err)
+        return nil, toChaincodeError(fn, err)
+    }
+    return result, nil
+}
+
+
+func (dcc *DecodedChainCode) invoke(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
+    return dcc.dispatch(stub, fn, args, true)
 }
 
 
 // Query is our entry point for queries
 func (dcc *DecodedChainCode) Query(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
-    // Handle different functions
-    if fn == "read" { // read a variable
-        return dcc.read(stub, fn, args)
-    } else if fn == "readAll" { // read all ledgers, returns the ids
-        return dcc.readAll(stub, fn, args)
-    } else if fn == "readAllOwners" { // read all owners and return full data for them.
-        return dcc.readAllOwners(stub, fn, args)
-    } else if fn == "readAllAssets" { // read all assets and return full data for them.
-        return dcc.readAllAssets(stub, fn, args)
-    } else if fn == "readAllTransactions" { // read all transactions and return full data for them.
-        return dcc.readAllTransactions(stub, fn, args)
+    result, err := dcc.query(stub, fn, args)
+    if err != nil {
+        return nil, toChaincodeError(fn, err)
     }
-    utils.PrintError("ERROR: Query function did not find ChainCode function: " + fn)
-    return nil, errors.New(" --- QUERY ERROR: Received unknown function query")
+    return result, nil
+}
+
+
+func (dcc *DecodedChainCode) query(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
+    return dcc.dispatch(stub, fn, args, false)
 }
 
 
 // ============================================================================================================================
 
 
-// Function that reads the bytes associated with a data-key and returns the byte-array.
+// Function that reads the bytes associated with an entity and returns the byte-array.
 func (dcc *DecodedChainCode) read(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
     var err error
-    if len(args) != 1 { // needs a data key to read.
-        err = errors.New("{\"Error\":\"Incorrect number of arguments\", \"Function\":\"" + fn + "\"}")
-        utils.PrintErrorFull("", err)
+    dataKey, err := stateKey(args[0], args[1])
+    if err != nil {
+        utils.PrintErrorFull("read - stateKey", err)
         return nil, err
     }
-    dataKey := args[0]
     dataBytes, err := stub.GetState(dataKey)
     if dataBytes == nil { // deals with non existing data keys.
-        err = errors.New("{\"Error\":\"State " + dataKey + " does not exist\", \"Function\":\"" + fn + "\"}")
+        err = newChaincodeError(ERRNOTFOUND, fn, "State " + dataKey + " does not exist").withDetail("key", dataKey)
         utils.PrintErrorFull("", err)
         return nil, err
     }
     if err != nil {
-        err = errors.New("{\"Error\":\"Failed to get state for " + dataKey + "\", \"Function\":\"" + fn + "\"}")
+        err = newChaincodeError(ERRINTERNAL, fn, "Failed to get state for " + dataKey).withDetail("key", dataKey)
         utils.PrintErrorFull("", err)
         return nil, err
     } 
@@ -173,11 +213,6 @@ func (dcc *DecodedChainCode) read(stub shim.ChaincodeStubInterface, fn string, a
 func (dcc *DecodedChainCode) readAll(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
     var err error
     var emptyArgs []string
-    if len(args) != 0 {
-        err = errors.New("{\"Error\":\"Incorrect number of arguments\", \"Function\":\"" + fn + "\"}")
-        utils.PrintErrorFull("", err)
-        return nil, err
-    }
     // get all owners - returns an array of strings.
     ownersLedger, err := dcc.getDataArrayStrings(stub, PRIMARYKEY[0], emptyArgs)
     if err != nil {
@@ -222,49 +257,105 @@ func (dcc *DecodedChainCode) readAll(stub shim.ChaincodeStubInterface, fn string
 }
 
 
+// Returns the ids in a ledger. The ledger is read with a range query over its entries.
 func (dcc *DecodedChainCode) getDataArrayStrings(stub shim.ChaincodeStubInterface, dataKey string, args []string) ([]string, error) {
     var err error
-    var empty []string
+    outputArray := []string{}
     if len(args) != 0 {
-        err = errors.New("{\"Error\":\"Incorrect number of arguments\", \"Function\":\"getDataArrayStrings\"}")
+        err = argumentCountError("getDataArrayStrings")
         utils.PrintErrorFull("", err)
-        return empty, err
+        return outputArray, err
     }
-    arrayBytes, err := stub.GetState(dataKey)
+    startKey, endKey := prefixRange(ledgerEntryPrefix(dataKey))
+    iterator, err := stub.RangeQueryState(startKey, endKey)
     if err != nil {
-        utils.PrintErrorFull("getDataArrayStrings - GetState", err)
-        return empty, err
+        utils.PrintErrorFull("getDataArrayStrings - RangeQueryState", err)
+        return outputArray, err
     }
-    var outputArray []string
-    if err = json.Unmarshal(arrayBytes, &outputArray); err != nil {
-        utils.PrintErrorFull("getDataArrayStrings - Unmarshal", err)
-        return empty, err
+    defer iterator.Close()
+    for iterator.HasNext() {
+        _, idBytes, err := iterator.Next()
+        if err != nil {
+            utils.PrintErrorFull("getDataArrayStrings - Next", err)
+            return outputArray, err
+        }
+        outputArray = append(outputArray, string(idBytes))
     }
     return outputArray, nil
 }
 
 
-func (dcc *DecodedChainCode) saveStringToDataArray(stub shim.ChaincodeStubInterface, dataKey string, addString string, ledger []string) ([]byte, error) {
+// Every ledger entry is written under its own key, so adding an id never rewrites the other entries.
+func (dcc *DecodedChainCode) addToLedger(stub shim.ChaincodeStubInterface, dataKey string, id string) (error) {
+    return stub.PutState(ledgerEntryKey(dataKey, id), []byte(id))
+}
+
+
+func (dcc *DecodedChainCode) removeFromLedger(stub shim.ChaincodeStubInterface, dataKey string, id string) (error) {
+    return stub.DelState(ledgerEntryKey(dataKey, id))
+}
+
+
+// Removes every entry from a ledger. The records the entries point to are left alone.
+func (dcc *DecodedChainCode) clearLedger(stub shim.ChaincodeStubInterface, dataKey string) (error) {
     var err error
-    // Add the string to the array
-    ledger = append(ledger, addString)
-    if err = dcc.saveLedger(stub, dataKey, ledger); err != nil {
-        utils.PrintErrorFull("saveStringToDataArray - saveLedger", err)
-        return nil, err
+    var emptyArgs []string
+    ledger, err := dcc.getDataArrayStrings(stub, dataKey, emptyArgs)
+    if err != nil {
+        return err
+    }
+    for _, id := range ledger {
+        if err = dcc.removeFromLedger(stub, dataKey, id); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+
+// Function that checks if the caller carries the admin role in its certificate attributes.
+func (dcc *DecodedChainCode) verifyAdmin(stub shim.ChaincodeStubInterface, fn string) (error) {
+    var err error
+    role, err := stub.ReadCertAttribute(ADMINATTRIBUTE)
+    if err != nil || string(role) != ADMINROLE {
+        err = newChaincodeError(ERRNOTADMIN, fn, "Caller is not an admin")
+        return err
+    }
+    return nil
+}
+
+
+// Function that turns `field, value, field, value, ...` arguments into a map. Only the allowed fields can be used, once each.
+func (dcc *DecodedChainCode) parseFieldPairs(fn string, pairs []string, allowedFields []string) (map[string]string, error) {
+    fields := make(map[string]string)
+    fieldErrors := FieldErrors{}
+    if len(pairs) == 0 || len(pairs) % 2 != 0 {
+        err := newChaincodeError(ERRINVALIDARGUMENTS, fn, "Fields need to be passed as field and value pairs")
+        return fields, err
+    }
+    for i := 0; i < len(pairs); i += 2 {
+        field := pairs[i]
+        if utils.IsElementInSlice(allowedFields, field) == false {
+            fieldErrors[field] = "is not a known field"
+        } else if _, ok := fields[field]; ok {
+            fieldErrors[field] = "is given more than once"
+        }
+        fields[field] = pairs[i + 1]
     }
-    return nil, nil
+    return fields, fieldErrors.toError(fn)
 }
 
 
-func (dcc *DecodedChainCode) saveLedger(stub shim.ChaincodeStubInterface, dataKey string, ledger []string) (error) {
+// Function that checks the version an update was based on is still the current version.
+func (dcc *DecodedChainCode) verifyVersion(fn string, id string, expected string, current int) (error) {
     var err error
-    // Marshall the ledger to bytes
-    bytesToWrite, err := json.Marshal(&ledger)
+    version, err := strconv.Atoi(expected)
     if err != nil {
+        err = newChaincodeError(ERRINVALIDARGUMENTS, fn, "Version must be a number").withDetail("version", "must be a number")
         return err
     }
-    // Save the array.
-    if err = stub.PutState(dataKey, bytesToWrite); err != nil {
+    if version != current {
+        err = newChaincodeError(ERRVERSIONCONFLICT, fn, "Version conflict for " + id).withDetail("expected", expected).withDetail("current", strconv.Itoa(current))
         return err
     }
     return nil
@@ -0,0 +1,496 @@
+/*
+
+DECODED HYPERLEDGER APPLICATION
+
+Market data. Every settled trade (validated straight away or approved later) updates the statistics of its asset.
+Trades count at the time the transaction was created, so every peer files them in the same buckets. A trade approved
+after newer trades settled does not replace their last price or the close of their candles:
+    - Last trade price and time.
+    - Volume and VWAP over the last 24 hours and since the first trade.
+    - OHLC candles for every configured interval. Admins set the intervals with `setCandleIntervals`,
+      new intervals only get candles for the trades settled from then on.
+
+Candles and the volume of the 24h window are stored one key per bucket so that a time range is read with a range
+query, and a trade only writes the buckets it falls in:
+
+    candle:<assetId>:<interval>:<bucket start, zero-padded>
+    window:<assetId>:<bucket start, zero-padded>
+
+The window buckets are five minutes long, the 24h figures count the buckets that start within the last 24 hours.
+Buckets that have left the window are deleted by the next trade in the asset.
+
+DecodedChainCode functions:
+- getCandleIntervals - private function
+- getMarketStats - private function
+- addToWindow - private function
+- readWindow - private function
+- updateMarketData - private function
+- setCandleIntervals
+- readMarketStats
+- readCandles
+
+MarketStats functions:
+- save
+- addTrade
+
+*/
+
+
+package main
+
+
+import (
+    "encoding/json"
+    "fmt"
+    "sort"
+    "strconv"
+    "time"
+
+    "github.com/hyperledger/fabric/core/chaincode/shim"
+
+    utils "github.com/DecodedCo/blockchain-marketplace-chaincode/utils"
+)
+
+
+// ============================================================================================================================
+
+
+// The state key the candle intervals are stored under.
+const CANDLEINTERVALSKEY = "CandleIntervals"
+
+// One minute, one hour and one day.
+var DEFAULTCANDLEINTERVALS = []int64{ 60, 3600, 86400 }
+
+// Length of the rolling window of the 24h statistics, and of the buckets it is counted in, in seconds.
+const STATSWINDOW = 86400
+const STATSBUCKET = 300
+
+
+type Trade struct {
+    Price           float64         `json:"price"`
+    Quantity        int             `json:"quantity"`
+    Timestamp       int64           `json:"timestamp"`
+}
+
+
+type MarketStats struct {
+    AssetId         string          `json:"assetId"`
+    LastPrice       float64         `json:"lastPrice"`
+    LastTradeTS     int64           `json:"lastTradeAt"`
+    Volume          int             `json:"volume"` // Since the first trade.
+    Notional        float64         `json:"notional"`
+    VWAP            float64         `json:"vwap"`
+    Volume24h       int             `json:"volume24h"`
+    VWAP24h         float64         `json:"vwap24h"` // The 24h figures are read from the window buckets.
+}
+
+
+// The trades of an asset in one bucket of the 24h window.
+type WindowBucket struct {
+    Start           int64           `json:"start"`
+    Volume          int             `json:"volume"`
+    Notional        float64         `json:"notional"`
+}
+
+
+type Candle struct {
+    AssetId         string          `json:"assetId"`
+    Interval        int64           `json:"interval"`
+    Start           int64           `json:"start"`
+    Open            float64         `json:"open"`
+    High            float64         `json:"high"`
+    Low             float64         `json:"low"`
+    Close           float64         `json:"close"`
+    Volume          int             `json:"volume"`
+    OpenedAt        int64           `json:"openedAt"` // Times of the trades that opened and closed the candle.
+    ClosedAt        int64           `json:"closedAt"`
+}
+
+
+// Sorts candle intervals, shortest first.
+type candleIntervals []int64
+
+func (c candleIntervals) Len() int { return len(c) }
+func (c candleIntervals) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c candleIntervals) Less(i, j int) bool { return c[i] < c[j] }
+
+
+func marketStatsKey(assetId string) (string) {
+    return ENTITYPREFIX["market"] + assetId
+}
+
+
+func candlePrefix(assetId string, interval int64) (string) {
+    return ENTITYPREFIX["candle"] + assetId + KEYSEPARATOR + strconv.FormatInt(interval, 10) + KEYSEPARATOR
+}
+
+
+// The bucket start is zero-padded so that the keys sort by time.
+func candleKey(assetId string, interval int64, start int64) (string) {
+    return candlePrefix(assetId, interval) + fmt.Sprintf("%012d", start)
+}
+
+
+func windowPrefix(assetId string) (string) {
+    return ENTITYPREFIX["window"] + assetId + KEYSEPARATOR
+}
+
+
+// Zero-padded like the candle keys. The key of any timestamp sorts right after the buckets that start before it.
+func windowKey(assetId string, start int64) (string) {
+    return windowPrefix(assetId) + fmt.Sprintf("%012d", start)
+}
+
+
+// ============================================================================================================================
+
+
+func (ms *MarketStats) save(stub shim.ChaincodeStubInterface) (error) {
+    var err error
+    statsBytesToWrite, err := json.Marshal(&ms)
+    if err != nil {
+        utils.PrintErrorFull("save - Marshal", err)
+        return err
+    }
+    if err = stub.PutState(marketStatsKey(ms.AssetId), statsBytesToWrite); err != nil {
+        utils.PrintErrorFull("save - PutState", err)
+        return err
+    }
+    return nil
+} // end of ms.save
+
+
+func (ms *MarketStats) addTrade(trade Trade) {
+    if trade.Timestamp >= ms.LastTradeTS {
+        ms.LastPrice = trade.Price
+        ms.LastTradeTS = trade.Timestamp
+    }
+    ms.Volume = ms.Volume + trade.Quantity
+    ms.Notional = ms.Notional + trade.Price * float64(trade.Quantity)
+    if ms.Volume > 0 {
+        ms.VWAP = ms.Notional / float64(ms.Volume)
+    }
+} // end of ms.addTrade
+
+
+// ============================================================================================================================
+
+
+func (dcc *DecodedChainCode) getCandleIntervals(stub shim.ChaincodeStubInterface) ([]int64, error) {
+    var err error
+    intervals := DEFAULTCANDLEINTERVALS
+    intervalsBytes, err := stub.GetState(systemKey(CANDLEINTERVALSKEY))
+    if err != nil {
+        return nil, err
+    }
+    if intervalsBytes == nil {
+        return intervals, nil
+    }
+    if err = json.Unmarshal(intervalsBytes, &intervals); err != nil {
+        return nil, err
+    }
+    return intervals, nil
+} // end of dcc.getCandleIntervals
+
+
+// Assets that never traded have empty statistics.
+func (dcc *DecodedChainCode) getMarketStats(stub shim.ChaincodeStubInterface, assetId string) (MarketStats, error) {
+    var err error
+    stats := MarketStats{ AssetId: assetId }
+    statsBytes, err := stub.GetState(marketStatsKey(assetId))
+    if err != nil {
+        return stats, err
+    }
+    if statsBytes == nil {
+        return stats, nil
+    }
+    if err = json.Unmarshal(statsBytes, &stats); err != nil {
+        return stats, err
+    }
+    return stats, nil
+} // end of dcc.getMarketStats
+
+
+// Adds a trade to its bucket of the 24h window and deletes the buckets the window has moved past.
+// A trade that is already outside the window, approved more than 24 hours after it was made, is left out.
+func (dcc *DecodedChainCode) addToWindow(stub shim.ChaincodeStubInterface, assetId string, trade Trade) (error) {
+    var err error
+    expiredKeys := []string{}
+    startKey, _ := prefixRange(windowPrefix(assetId))
+    iterator, err := stub.RangeQueryState(startKey, windowKey(assetId, trade.Timestamp - STATSWINDOW + 1))
+    if err != nil {
+        return err
+    }
+    for iterator.HasNext() {
+        key, _, err := iterator.Next()
+        if err != nil {
+            iterator.Close()
+            return err
+        }
+        expiredKeys = append(expiredKeys, key)
+    }
+    iterator.Close()
+    for _, key := range expiredKeys {
+        if err = stub.DelState(key); err != nil {
+            return err
+        }
+    }
+    start := trade.Timestamp - trade.Timestamp % STATSBUCKET
+    if start <= trade.Timestamp - STATSWINDOW {
+        return nil
+    }
+    bucket := WindowBucket{ Start: start }
+    bucketBytes, err := stub.GetState(windowKey(assetId, start))
+    if err != nil {
+        return err
+    }
+    if bucketBytes != nil {
+        if err = json.Unmarshal(bucketBytes, &bucket); err != nil {
+            return err
+        }
+    }
+    bucket.Volume = bucket.Volume + trade.Quantity
+    bucket.Notional = bucket.Notional + trade.Price * float64(trade.Quantity)
+    bucketBytes, err = json.Marshal(&bucket)
+    if err != nil {
+        return err
+    }
+    return stub.PutState(windowKey(assetId, start), bucketBytes)
+} // end of dcc.addToWindow
+
+
+// Fills in the 24h volume and VWAP of the statistics from the buckets that start within 24 hours of now.
+func (dcc *DecodedChainCode) readWindow(stub shim.ChaincodeStubInterface, stats *MarketStats, now int64) (error) {
+    var err error
+    notional := 0.0
+    stats.Volume24h = 0
+    stats.VWAP24h = 0
+    _, endKey := prefixRange(windowPrefix(stats.AssetId))
+    iterator, err := stub.RangeQueryState(windowKey(stats.AssetId, now - STATSWINDOW + 1), endKey)
+    if err != nil {
+        return err
+    }
+    defer iterator.Close()
+    for iterator.HasNext() {
+        _, bucketBytes, err := iterator.Next()
+        if err != nil {
+            return err
+        }
+        var bucket WindowBucket
+        if err = json.Unmarshal(bucketBytes, &bucket); err != nil {
+            return err
+        }
+        stats.Volume24h = stats.Volume24h + bucket.Volume
+        notional = notional + bucket.Notional
+    }
+    if stats.Volume24h > 0 {
+        stats.VWAP24h = notional / float64(stats.Volume24h)
+    }
+    return nil
+} // end of dcc.readWindow
+
+
+// Adds a settled trade to the statistics, the 24h window and the candles of its asset.
+func (dcc *DecodedChainCode) updateMarketData(stub shim.ChaincodeStubInterface, transaction Transaction) (error) {
+    var err error
+    trade := Trade{ Price: transaction.Price, Quantity: transaction.Quantity, Timestamp: transaction.Created }
+    stats, err := dcc.getMarketStats(stub, transaction.AssetId)
+    if err != nil {
+        return err
+    }
+    stats.addTrade(trade)
+    if err = stats.save(stub); err != nil {
+        return err
+    }
+    if err = dcc.addToWindow(stub, transaction.AssetId, trade); err != nil {
+        return err
+    }
+    intervals, err := dcc.getCandleIntervals(stub)
+    if err != nil {
+        return err
+    }
+    for _, interval := range intervals {
+        start := trade.Timestamp - trade.Timestamp % interval
+        key := candleKey(transaction.AssetId, interval, start)
+        candleBytes, err := stub.GetState(key)
+        if err != nil {
+            return err
+        }
+        candle := Candle{ AssetId: transaction.AssetId, Interval: interval, Start: start, Open: trade.Price, High: trade.Price, Low: trade.Price,
+            OpenedAt: trade.Timestamp }
+        if candleBytes != nil {
+            if err = json.Unmarshal(candleBytes, &candle); err != nil {
+                return err
+            }
+        }
+        // Candles written before the times were kept have them at zero: their open stays, their close is replaced.
+        if trade.Timestamp < candle.OpenedAt {
+            candle.Open = trade.Price
+            candle.OpenedAt = trade.Timestamp
+        }
+        if trade.Price > candle.High {
+            candle.High = trade.Price
+        }
+        if trade.Price < candle.Low {
+            candle.Low = trade.Price
+        }
+        if trade.Timestamp >= candle.ClosedAt {
+            candle.Close = trade.Price
+            candle.ClosedAt = trade.Timestamp
+        }
+        candle.Volume = candle.Volume + trade.Quantity
+        candleBytes, err = json.Marshal(&candle)
+        if err != nil {
+            return err
+        }
+        if err = stub.PutState(key, candleBytes); err != nil {
+            return err
+        }
+    }
+    return nil
+} // end of dcc.updateMarketData
+
+
+// Admin function. Takes the candle intervals in seconds, for example "60", "3600", "86400".
+func (dcc *DecodedChainCode) setCandleIntervals(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
+    var err error
+    intervals := []int64{}
+    for _, arg := range args {
+        interval, err := strconv.ParseInt(arg, 10, 64)
+        if err != nil || interval <= 0 {
+            err = newChaincodeError(ERRINVALIDARGUMENTS, fn, "Candle intervals must be positive numbers of seconds").withDetail("interval", arg)
+            utils.PrintErrorFull("", err)
+            return nil, err
+        }
+        for _, existing := range intervals {
+            if existing == interval {
+                err = newChaincodeError(ERRINVALIDARGUMENTS, fn, "Duplicate candle interval " + arg).withDetail("interval", arg)
+                utils.PrintErrorFull("", err)
+                return nil, err
+            }
+        }
+        intervals = append(intervals, interval)
+    }
+    sort.Sort(candleIntervals(intervals))
+    intervalsBytes, err := json.Marshal(&intervals)
+    if err != nil {
+        utils.PrintErrorFull("setCandleIntervals - Marshal", err)
+        return nil, err
+    }
+    if err = stub.PutState(systemKey(CANDLEINTERVALSKEY), intervalsBytes); err != nil {
+        utils.PrintErrorFull("setCandleIntervals - PutState", err)
+        return nil, err
+    }
+    recordEvent(stub, EVENTCANDLEINTERVALSSET, "", map[string]string{ "intervals": string(intervalsBytes) })
+    utils.PrintSuccess("Set the candle intervals.")
+    result := newInvokeResult(fn, "", "Set")
+    return result.toBytes()
+} // end of dcc.setCandleIntervals
+
+
+// Returns the last price, volume and VWAP of an asset. The 24h figures are as of the time of the query.
+func (dcc *DecodedChainCode) readMarketStats(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
+    var err error
+    if _, err = dcc.getAsset(stub, []string{ args[0] }); err != nil {
+        utils.PrintErrorFull("readMarketStats - getAsset", err)
+        return nil, err
+    }
+    stats, err := dcc.getMarketStats(stub, args[0])
+    if err != nil {
+        utils.PrintErrorFull("readMarketStats - getMarketStats", err)
+        return nil, err
+    }
+    if err = dcc.readWindow(stub, &stats, time.Now().Unix()); err != nil {
+        utils.PrintErrorFull("readMarketStats - readWindow", err)
+        return nil, err
+    }
+    statsBytes, err := json.Marshal(&stats)
+    if err != nil {
+        utils.PrintErrorFull("readMarketStats - Marshal", err)
+        return nil, err
+    }
+    utils.PrintSuccess("Retrieved the market statistics of asset " + args[0])
+    return statsBytes, nil
+} // end of dcc.readMarketStats
+
+
+// Returns the candles of an asset for one of the configured intervals, oldest first.
+// Args: assetId, interval in seconds, and optionally from and to as unix timestamps (from inclusive, to exclusive).
+func (dcc *DecodedChainCode) readCandles(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
+    var err error
+    if len(args) != 2 && len(args) != 4 {
+        err = argumentCountError(fn)
+        utils.PrintErrorFull("", err)
+        return nil, err
+    }
+    assetId := args[0]
+    interval, err := strconv.ParseInt(args[1], 10, 64)
+    if err != nil {
+        utils.PrintErrorFull("readCandles - ParseInt", err)
+        return nil, err
+    }
+    intervals, err := dcc.getCandleIntervals(stub)
+    if err != nil {
+        utils.PrintErrorFull("readCandles - getCandleIntervals", err)
+        return nil, err
+    }
+    isConfigured := false
+    for _, configured := range intervals {
+        isConfigured = isConfigured || configured == interval
+    }
+    if isConfigured == false {
+        err = newChaincodeError(ERRINVALIDARGUMENTS, fn, "No candles are kept for interval " + args[1]).withDetail("interval", args[1])
+        utils.PrintErrorFull("", err)
+        return nil, err
+    }
+    if _, err = dcc.getAsset(stub, []string{ assetId }); err != nil {
+        utils.PrintErrorFull("readCandles - getAsset", err)
+        return nil, err
+    }
+    startKey, endKey := prefixRange(candlePrefix(assetId, interval))
+    if len(args) == 4 {
+        from, err := strconv.ParseInt(args[2], 10, 64)
+        if err != nil {
+            utils.PrintErrorFull("readCandles - ParseInt", err)
+            return nil, err
+        }
+        to, err := strconv.ParseInt(args[3], 10, 64)
+        if err != nil {
+            utils.PrintErrorFull("readCandles - ParseInt", err)
+            return nil, err
+        }
+        // The bucket the from timestamp falls in is included.
+        startKey = candleKey(assetId, interval, from - from % interval)
+        endKey = candleKey(assetId, interval, to)
+    }
+    iterator, err := stub.RangeQueryState(startKey, endKey)
+    if err != nil {
+        utils.PrintErrorFull("readCandles - RangeQueryState", err)
+        return nil, err
+    }
+    defer iterator.Close()
+    candles := []Candle{}
+    for iterator.HasNext() {
+        _, candleBytes, err := iterator.Next()
+        if err != nil {
+            utils.PrintErrorFull("readCandles - Next", err)
+            return nil, err
+        }
+        var candle Candle
+        if err = json.Unmarshal(candleBytes, &candle); err != nil {
+            utils.PrintErrorFull("readCandles - Unmarshal", err)
+            return nil, err
+        }
+        candles = append(candles, candle)
+    }
+    candlesBytes, err := json.Marshal(&candles)
+    if err != nil {
+        utils.PrintErrorFull("readCandles - Marshal", err)
+        return nil, err
+    }
+    utils.PrintSuccess("Retrieved the candles of asset " + assetId)
+    return candlesBytes, nil
+} // end of dcc.readCandles
+
+
+// ============================================================================================================================
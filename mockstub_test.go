@@ -0,0 +1,150 @@
+/*
+
+DECODED HYPERLEDGER APPLICATION
+
+In-memory stand-in for the chaincode stub, for the tests. It keeps the state in a map, answers range queries in key
+order, hands out certificate attributes that the test sets and keeps the events the chaincode sets. The rest of the
+stub interface is not implemented and panics when called.
+
+mockStub functions:
+- newMockStub
+- setAttribute
+- GetState, PutState, DelState, RangeQueryState
+- ReadCertAttribute
+- SetEvent
+
+*/
+
+
+package main
+
+
+import (
+    "errors"
+    "sort"
+
+    "github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+
+// ============================================================================================================================
+
+
+type mockEvent struct {
+    Name        string
+    Payload     []byte
+}
+
+
+type mockStub struct {
+    shim.ChaincodeStubInterface
+    state       map[string][]byte
+    attributes  map[string]string
+    events      []mockEvent
+}
+
+
+type mockIterator struct {
+    keys        []string
+    values      [][]byte
+    position    int
+}
+
+
+// ============================================================================================================================
+
+
+func newMockStub() (*mockStub) {
+    return &mockStub{ state: make(map[string][]byte), attributes: make(map[string]string) }
+}
+
+
+// An empty value removes the attribute.
+func (ms *mockStub) setAttribute(name string, value string) {
+    if value == "" {
+        delete(ms.attributes, name)
+        return
+    }
+    ms.attributes[name] = value
+}
+
+
+// Values are copied in and out, so the chaincode never shares a slice with the state.
+func (ms *mockStub) GetState(key string) ([]byte, error) {
+    value, ok := ms.state[key]
+    if ok == false {
+        return nil, nil
+    }
+    return append([]byte{}, value...), nil
+}
+
+
+func (ms *mockStub) PutState(key string, value []byte) (error) {
+    if key == "" {
+        return errors.New("key must not be empty")
+    }
+    ms.state[key] = append([]byte{}, value...)
+    return nil
+}
+
+
+func (ms *mockStub) DelState(key string) (error) {
+    delete(ms.state, key)
+    return nil
+}
+
+
+// The keys from startKey up to but not including endKey, in order.
+func (ms *mockStub) RangeQueryState(startKey string, endKey string) (shim.StateRangeQueryIteratorInterface, error) {
+    iterator := &mockIterator{}
+    for key := range ms.state {
+        if key >= startKey && key < endKey {
+            iterator.keys = append(iterator.keys, key)
+        }
+    }
+    sort.Strings(iterator.keys)
+    for _, key := range iterator.keys {
+        iterator.values = append(iterator.values, append([]byte{}, ms.state[key]...))
+    }
+    return iterator, nil
+}
+
+
+func (ms *mockStub) ReadCertAttribute(attributeName string) ([]byte, error) {
+    value, ok := ms.attributes[attributeName]
+    if ok == false {
+        return nil, errors.New("attribute " + attributeName + " not found")
+    }
+    return []byte(value), nil
+}
+
+
+func (ms *mockStub) SetEvent(name string, payload []byte) (error) {
+    ms.events = append(ms.events, mockEvent{ Name: name, Payload: append([]byte{}, payload...) })
+    return nil
+}
+
+
+// ============================================================================================================================
+
+
+func (it *mockIterator) HasNext() (bool) {
+    return it.position < len(it.keys)
+}
+
+
+func (it *mockIterator) Next() (string, []byte, error) {
+    if it.HasNext() == false {
+        return "", nil, errors.New("no more keys")
+    }
+    it.position++
+    return it.keys[it.position - 1], it.values[it.position - 1], nil
+}
+
+
+func (it *mockIterator) Close() (error) {
+    return nil
+}
+
+
+// ============================================================================================================================
@@ -5,10 +5,14 @@ DECODED HYPERLEDGER APPLICATION
 DecodedChainCode functions:
 - createOwner - private functions
 - getOwner - private functions
-- addOwner, addOwnerString, addOwnerJSON: adds an owner using a number of string arguments or a single JSON-encoded argument.
+- addOwner, addOwnerString, addOwnerJSON: adds an owner using a number of string arguments or a single JSON-encoded argument (see jsonargs.go).
 - assignAssetToOwner - private function
 - readAllOwners
-- changeOwnerValidationStatus
+- validateOwner
+- revokeOwnerValidation
+- freezeOwner
+- unfreezeOwner
+- closeOwner
 
 Owner functions:
 - save
@@ -21,7 +25,10 @@ Owner functions:
 - rollbackBuyTransaction
 - verifyBalance
 - isValidated
-- toggleValidation
+- isActive
+- addAudit
+- verifyClosable
+- applyUpdate
 
 */
 
@@ -32,7 +39,7 @@ package main
 import (
     "encoding/json"
     "strconv"
-    "errors"
+    "time"
 
     "github.com/hyperledger/fabric/core/chaincode/shim"
 
@@ -58,6 +65,14 @@ type Owner struct {
     Issued          []string    `json:"issuedIds"` // Assets that this company issued.
     //
     Transactions    []string    `json:"transactions"` // transaction ids
+    //
+    Frozen          bool        `json:"frozen"`
+    Closed          bool        `json:"closed"` // Closed owners are kept in state but removed from the Owners ledger.
+    AuditLog        []OwnerAudit `json:"auditLog"`
+    //
+    KYC             OwnerKYC    `json:"kyc"`
+    //
+    Version         int         `json:"version"` // Increased on every update, to detect conflicting edits.
 }
 
 
@@ -68,6 +83,26 @@ type OwnerInfo struct {
 }
 
 
+type OwnerKYC struct {
+    Reviewer        string      `json:"reviewer"`
+    Expiry          string      `json:"expiry"` // YYYY-MM-DD, the validation is no longer valid from this date on.
+    ExpiryTS        int64       `json:"expiryTS"`
+    DocumentHash    string      `json:"documentHash"`
+    ValidatedTS     int64       `json:"validatedAt"`
+}
+
+
+type OwnerAudit struct {
+    Action          string      `json:"action"`
+    Reason          string      `json:"reason"`
+    Timestamp       int64       `json:"timestamp"`
+}
+
+
+// Fields that can be changed with updateOwner.
+var OWNERUPDATEFIELDS = []string{ "name", "tag", "description", "logo", "background" }
+
+
 // ============================================================================================================================
 
 
@@ -78,7 +113,7 @@ func (o *Owner) save(stub shim.ChaincodeStubInterface) (error) {
         utils.PrintErrorFull("save - Marshal", err)
         return err
     }
-    if err = stub.PutState(o.OwnerId, ownerBytesToWrite); err != nil {
+    if err = stub.PutState(ownerKey(o.OwnerId), ownerBytesToWrite); err != nil {
         utils.PrintErrorFull("save - PutState", err)
         return err
     }
@@ -95,9 +130,9 @@ func (o *Owner) addAsset(assetId string) {
 
 
 func (o *Owner) removeAsset(asset *Asset, quantity int) {
-    // If it is the full holding, delete from the slice.
-    ownsQuantity := asset.OwnedBy[o.OwnerId].Quantity
-    if ownsQuantity == quantity {
+    // If it is the full holding and nothing is in escrow, delete from the slice.
+    ownedBy := asset.OwnedBy[o.OwnerId]
+    if ownedBy.Quantity == quantity && ownedBy.EscrowQty == 0 {
         o.deleteAsset(asset.Id)
     }
 } // end of o.removeAsset
@@ -133,33 +168,81 @@ func (o *Owner) rollbackBuyTransaction(amount float64) {
 } // end of o.rollbackBuyTransaction
 
 
-func (o *Owner) verifyBalance(amount float64) (error) {
+func (o *Owner) verifyBalance(fn string, amount float64) (error) {
     var err error
     if o.Balance < amount {
-        err = errors.New("Insufficient balance.")
+        err = newChaincodeError(ERRINSUFFICIENTBALANCE, fn, "Insufficient balance").withDetail("ownerId", o.OwnerId)
         return err
     }
     return nil
 } // end of o.verifyBalance
 
 
+// Owners validated before KYC metadata existed have no expiry.
 func (o *Owner) isValidated(fn string) (error) {
     var err error
     if o.Validated == false {
-        err = errors.New("{\"Error\":\"Owner " + o.OwnerId + " is not validated\", \"Function\":\"" + fn + "\"}")
+        err = newChaincodeError(ERRNOTVALIDATED, fn, "Owner " + o.OwnerId + " is not validated").withDetail("ownerId", o.OwnerId)
+        return err
+    }
+    if o.KYC.ExpiryTS != 0 && time.Now().Unix() >= o.KYC.ExpiryTS {
+        err = newChaincodeError(ERRVALIDATIONEXPIRED, fn, "Validation of owner " + o.OwnerId + " expired on " + o.KYC.Expiry).withDetail("ownerId", o.OwnerId).withDetail("expiry", o.KYC.Expiry)
         return err
     }
     return nil
 } // end of o.isValidated
 
 
-func (o *Owner) toggleValidation() {
-    if o.Validated == true {
-        o.Validated = false
-    } else {
-        o.Validated = true
+// Frozen and closed owners cannot trade or issue.
+func (o *Owner) isActive(fn string) (error) {
+    var err error
+    if o.Closed == true {
+        err = newChaincodeError(ERROWNERCLOSED, fn, "Owner " + o.OwnerId + " is closed").withDetail("ownerId", o.OwnerId)
+        return err
     }
-} // end of o.toggleValidation
+    if o.Frozen == true {
+        err = newChaincodeError(ERROWNERFROZEN, fn, "Owner " + o.OwnerId + " is frozen").withDetail("ownerId", o.OwnerId)
+        return err
+    }
+    return nil
+} // end of o.isActive
+
+
+func (o *Owner) addAudit(action string, reason string) {
+    audit := OwnerAudit{ Action: action, Reason: reason, Timestamp: time.Now().Unix() }
+    o.AuditLog = append(o.AuditLog, audit)
+} // end of o.addAudit
+
+
+// An owner can only be closed when it holds nothing: no funds, no escrow and no assets.
+func (o *Owner) verifyClosable(fn string) (error) {
+    var err error
+    if o.Balance != 0 || o.EscrowBalance != 0 || len(o.Assets) != 0 {
+        err = newChaincodeError(ERROWNERNOTEMPTY, fn, "Owner " + o.OwnerId + " still has a balance, escrow or holdings").withDetail("ownerId", o.OwnerId)
+        return err
+    }
+    return nil
+} // end of o.verifyClosable
+
+
+// Only the given fields change. The fields have been checked against OWNERUPDATEFIELDS.
+func (o *Owner) applyUpdate(fields map[string]string) {
+    for field, value := range fields {
+        switch field {
+            case "name":
+                o.Name = value
+            case "tag":
+                o.Tag = value
+            case "description":
+                o.Information.Description = value
+            case "logo":
+                o.Information.Logo = value
+            case "background":
+                o.Information.Background = value
+        }
+    }
+    o.Version = o.Version + 1
+} // end of o.applyUpdate
 
 
 // ============================================================================================================================
@@ -172,7 +255,7 @@ func (dcc *DecodedChainCode) createOwner(args []string) (Owner, error) {
     var owner Owner // We need to have an empty owner ready to return in case of an error.
     isValidated := false // Initialise as true for now.
     if len(args) != 6 { // OwnerId, fullname, balance, description, logo-url, tag
-        err = errors.New("{\"Error\":\"Incorrect number of arguments\", \"Function\":\"createOwner\"}")
+        err = argumentCountError("createOwner")
         utils.PrintErrorFull("", err)
         return owner, err
     }
@@ -204,14 +287,14 @@ func (dcc *DecodedChainCode) getOwner(stub shim.ChaincodeStubInterface, args []s
     var owner Owner // We need to have an empty owner ready to return in case of an error.
     var err error
     if len(args) != 1 { // Only needs an owner id.
-        err = errors.New("{\"Error\":\"Incorrect number of arguments\", \"Function\":\"getOwner\"}")
+        err = argumentCountError("getOwner")
         utils.PrintErrorFull("", err)
         return owner, err
     }
     ownerId := args[0]
-    ownerBytes, err := stub.GetState(ownerId)
+    ownerBytes, err := stub.GetState(ownerKey(ownerId))
     if ownerBytes == nil {
-        err = errors.New("{\"Error\":\"State " + ownerId + " does not exist\", \"Function\":\"getOwner\"}")
+        err = newChaincodeError(ERRNOTFOUND, "getOwner", "Owner " + ownerId + " does not exist").withDetail("ownerId", ownerId)
         utils.PrintErrorFull("", err)
         return owner, err
     }
@@ -230,22 +313,25 @@ func (dcc *DecodedChainCode) getOwner(stub shim.ChaincodeStubInterface, args []s
 
 func (dcc *DecodedChainCode) addOwner(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
     var err error
-    var emptyArgs []string
-    if len(args) != 6 { // OwnerId, fullname, balance, description, logo-url, tag
-        err = errors.New("{\"Error\":\"Incorrect number of arguments\", \"Function\":\"" + fn + "\"}")
+    // The JSON variant passes its arguments on to here, so the checks on the values are shared.
+    if balance, parseErr := strconv.ParseFloat(args[2], 64); parseErr == nil && balance < 0 {
+        err = newChaincodeError(ERRINVALIDARGUMENTS, fn, "Invalid arguments").withDetail("balance", "must not be negative")
         utils.PrintErrorFull("", err)
         return nil, err
     }
     // The OwnerId needs to be unique. Check if the owner does not already exist.
     ownerId := args[0]
-    // Get all the owners that are currently in the system.
-    ownersLedger, err := dcc.getDataArrayStrings(stub, PRIMARYKEY[0], emptyArgs)
+    if err = verifyId(fn, "ownerId", ownerId); err != nil {
+        utils.PrintErrorFull("addOwner - verifyId", err)
+        return nil, err
+    }
+    // Check if the owner record exists. This includes closed owners, which are no longer in the ledger of owners.
+    existingBytes, err := stub.GetState(ownerKey(ownerId))
     if err != nil {
-        utils.PrintErrorFull("addOwner - getDataArrayStrings", err)
+        utils.PrintErrorFull("addOwner - GetState", err)
         return nil, err
     }
-    // Check if the ownerId exists in the current ledger of owners.
-    ownerExists := utils.IsElementInSlice(ownersLedger, ownerId)
+    ownerExists := existingBytes != nil
     if ownerExists == false {
         // Create a new owner
         newOwner, err := dcc.createOwner(args)
@@ -259,16 +345,18 @@ func (dcc *DecodedChainCode) addOwner(stub shim.ChaincodeStubInterface, fn strin
             return nil, err
         }
         // Add owner to the list.
-        _, err = dcc.saveStringToDataArray(stub, PRIMARYKEY[0], ownerId, ownersLedger)
-        if err != nil {
-            utils.PrintErrorFull("addOwner - saveStringToDataArray", err)
+        if err = dcc.addToLedger(stub, PRIMARYKEY[0], ownerId); err != nil {
+            utils.PrintErrorFull("addOwner - addToLedger", err)
             return nil, err
         }
+        recordEvent(stub, EVENTOWNERCREATED, ownerId, map[string]string{ "name": newOwner.Name })
         // Done!
         utils.PrintSuccess("Successfully added a new owner: " + newOwner.Name)
-        return nil, nil
+        result := newInvokeResult(fn, ownerId, "Created")
+        result.addBalance(newOwner)
+        return result.toBytes()
     } else {
-        err = errors.New("Owner `" + ownerId + "` already exists.")
+        err = newChaincodeError(ERROWNEREXISTS, fn, "Owner " + ownerId + " already exists").withDetail("ownerId", ownerId)
         utils.PrintErrorFull("addOwner", err)
         return nil, err
     }
@@ -283,10 +371,16 @@ func (dcc *DecodedChainCode) addOwnerString(stub shim.ChaincodeStubInterface, fn
 } // end of dcc.addOwnerString
 
 
+// Patch-style update: only the fields that are passed change.
 func (dcc *DecodedChainCode) updateOwner(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
     var err error
-    if len(args) != 3 { // OwnerId, Description, Logo
-        err = errors.New("{\"Error\":\"Incorrect number of arguments\", \"Function\":\"" + fn + "\"}")
+    fields, err := dcc.parseFieldPairs(fn, args[2:], OWNERUPDATEFIELDS)
+    if err != nil {
+        utils.PrintErrorFull("updateOwner - parseFieldPairs", err)
+        return nil, err
+    }
+    if name, ok := fields["name"]; ok && name == "" {
+        err = newChaincodeError(ERRINVALIDARGUMENTS, fn, "Invalid arguments").withDetail("name", "must not be empty")
         utils.PrintErrorFull("", err)
         return nil, err
     }
@@ -297,16 +391,28 @@ func (dcc *DecodedChainCode) updateOwner(stub shim.ChaincodeStubInterface, fn st
         utils.PrintErrorFull("updateOwner - getOwner", err)
         return nil, err
     }
+    if owner.Closed == true {
+        err = newChaincodeError(ERROWNERCLOSED, fn, "Owner " + ownerId + " is closed").withDetail("ownerId", ownerId)
+        utils.PrintErrorFull("", err)
+        return nil, err
+    }
+    // The update has to be based on the current version.
+    if err = dcc.verifyVersion(fn, ownerId, args[1], owner.Version); err != nil {
+        utils.PrintErrorFull("updateOwner - verifyVersion", err)
+        return nil, err
+    }
     // Update the fields
-    owner.Information.Description = args[1]
-    owner.Information.Logo = args[2]
+    owner.applyUpdate(fields)
     // Save the new owner.
     if err = owner.save(stub); err != nil {
         utils.PrintErrorFull("updateOwner - save", err)
         return nil, err
     }
+    recordEvent(stub, EVENTOWNERUPDATED, owner.OwnerId, map[string]string{ "fields": changedFields(fields), "version": strconv.Itoa(owner.Version) })
     utils.PrintSuccess("Successfully updated owner: " + owner.Name)
-    return nil, nil
+    result := newInvokeResult(fn, owner.OwnerId, "Updated")
+    result.Version = owner.Version
+    return result.toBytes()
 } // end of dcc.updateOwner
 
 
@@ -328,70 +434,232 @@ func (dcc *DecodedChainCode) assignAssetToOwner(stub shim.ChaincodeStubInterface
 } // end of dcc.assignAssetToOwner
 
 
+// Function to read a page of owners and their information.
+// Optional JSON argument, see query.go. Filters: tag, status (validated, unvalidated or frozen).
 func (dcc *DecodedChainCode) readAllOwners(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
     var err error
-    var emptyArgs []string
-    if len(args) != 0 {
-        err = errors.New("{\"Error\":\"Incorrect number of arguments\", \"Function\":\"" + fn + "\"}")
+    query, err := dcc.parseListQuery(fn, args, []string{ "tag", "status" })
+    if err != nil {
+        utils.PrintErrorFull("readAllOwners - parseListQuery", err)
+        return nil, err
+    }
+    if utils.IsElementInSlice([]string{ "", "validated", "unvalidated", "frozen" }, query.Status) == false {
+        err = newChaincodeError(ERRINVALIDARGUMENTS, fn, "Invalid arguments").withDetail("status", "must be one of validated, unvalidated or frozen")
         utils.PrintErrorFull("", err)
         return nil, err
     }
-    // Get all owners - returns an slice of strings - ownerIds
-    ownersLedger, err := dcc.getDataArrayStrings(stub, PRIMARYKEY[0], emptyArgs)
-    if err != nil {
-        utils.PrintErrorFull("readAllOwners - getDataArrayStrings", err)
-        return nil, err
-    }
-    if len(ownersLedger) > 0 {
-        // Initialise an empty slice for the output
-        var fullOwnersLedger []Owner
-        // Iterate over all owners and return the owner object.
-        for _, ownerId := range ownersLedger {
-            thisOwner, err := dcc.getOwner(stub, []string{ ownerId })
-            if err != nil {
-                utils.PrintErrorFull("readAllOwners - getOwner", err)
-                return nil, err
-            }
-            fullOwnersLedger = append(fullOwnersLedger, thisOwner)
-        }
-        // This gives us an slice with owners. Translate to bytes and return
-        fullOwnersLedgerBytes, err := json.Marshal(&fullOwnersLedger)
+    page, err := dcc.readPage(stub, PRIMARYKEY[0], query, func(ownerId string) (interface{}, error) {
+        owner, err := dcc.getOwner(stub, []string{ ownerId })
         if err != nil {
-            utils.PrintErrorFull("readAllOwners - Marshal", err)
             return nil, err
         }
-        utils.PrintSuccess("Retrieved full information for all owners.")
-        return fullOwnersLedgerBytes, nil
-    } else {
-        return nil, nil
+        if query.Tag != "" && owner.Tag != query.Tag {
+            return nil, nil
+        }
+        isValidated := owner.isValidated(fn) == nil
+        if (query.Status == "validated" && isValidated == false) || (query.Status == "unvalidated" && isValidated) {
+            return nil, nil
+        }
+        if query.Status == "frozen" && owner.Frozen == false {
+            return nil, nil
+        }
+        return owner, nil
+    })
+    if err != nil {
+        utils.PrintErrorFull("readAllOwners - readPage", err)
+        return nil, err
+    }
+    pageBytes, err := json.Marshal(&page)
+    if err != nil {
+        utils.PrintErrorFull("readAllOwners - Marshal", err)
+        return nil, err
     }
-    return nil, nil // redundancy
+    utils.PrintSuccess("Retrieved a page of owners.")
+    return pageBytes, nil
 } // end of dcc.readAllOwners
 
 
-// Function just flips the validation status of the owner.
-func (dcc *DecodedChainCode) changeOwnerValidationStatus(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
+// Admin function. Validating is idempotent: validating again with the same KYC metadata changes nothing.
+func (dcc *DecodedChainCode) validateOwner(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
     var err error
-    if len(args) != 1 { // Only needs the ownerId.
-        err = errors.New("{\"Error\":\"Incorrect number of arguments\", \"Function\":\"" + fn + "\"}")
+    ownerId := args[0]
+    reviewer := args[1]
+    documentHash := args[3]
+    if reviewer == "" || documentHash == "" {
+        err = newChaincodeError(ERRINVALIDARGUMENTS, fn, "Reviewer and document hash are required")
+        utils.PrintErrorFull("", err)
+        return nil, err
+    }
+    expiry, err := time.Parse("2006-01-02", args[2])
+    if err != nil {
+        err = newChaincodeError(ERRINVALIDARGUMENTS, fn, "Expiry date " + args[2] + " is not a date").withDetail("expiry", "must be a date YYYY-MM-DD")
+        utils.PrintErrorFull("", err)
+        return nil, err
+    }
+    if expiry.Unix() <= time.Now().Unix() {
+        err = newChaincodeError(ERRINVALIDARGUMENTS, fn, "Expiry date " + args[2] + " is in the past").withDetail("expiry", "must be in the future")
         utils.PrintErrorFull("", err)
         return nil, err
     }
+    owner, err := dcc.getOwner(stub, []string{ ownerId })
+    if err != nil {
+        utils.PrintErrorFull("validateOwner - getOwner", err)
+        return nil, err
+    }
+    if owner.Closed == true {
+        err = newChaincodeError(ERROWNERCLOSED, fn, "Owner " + ownerId + " is closed").withDetail("ownerId", ownerId)
+        utils.PrintErrorFull("", err)
+        return nil, err
+    }
+    // A retry of the same validation leaves the owner untouched.
+    if owner.Validated && owner.KYC.Reviewer == reviewer && owner.KYC.Expiry == args[2] && owner.KYC.DocumentHash == documentHash {
+        utils.PrintSuccess("Owner " + ownerId + " is already validated")
+        result := newInvokeResult(fn, ownerId, "Validated")
+        return result.toBytes()
+    }
+    owner.Validated = true
+    owner.KYC = OwnerKYC{
+        Reviewer: reviewer,
+        Expiry: args[2],
+        ExpiryTS: expiry.Unix(),
+        DocumentHash: documentHash,
+        ValidatedTS: time.Now().Unix(),
+    }
+    owner.addAudit("validate", "reviewed by " + reviewer)
+    if err = owner.save(stub); err != nil {
+        utils.PrintErrorFull("validateOwner - save", err)
+        return nil, err
+    }
+    recordEvent(stub, EVENTOWNERVALIDATED, ownerId, map[string]string{ "reviewer": reviewer, "expiry": args[2] })
+    utils.PrintSuccess("Validated owner " + ownerId + " until " + args[2])
+    result := newInvokeResult(fn, ownerId, "Validated")
+    return result.toBytes()
+} // end of dcc.validateOwner
+
+
+// Admin function. Revoking an owner that is not validated changes nothing.
+func (dcc *DecodedChainCode) revokeOwnerValidation(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
+    var err error
     ownerId := args[0]
     owner, err := dcc.getOwner(stub, []string{ ownerId })
     if err != nil {
-        utils.PrintErrorFull("changeOwnerValidationStatus - getOwner", err)
+        utils.PrintErrorFull("revokeOwnerValidation - getOwner", err)
         return nil, err
     }
-    // Flip the validation status of the owner.
-    owner.toggleValidation()
+    if owner.Closed == true {
+        err = newChaincodeError(ERROWNERCLOSED, fn, "Owner " + ownerId + " is closed").withDetail("ownerId", ownerId)
+        utils.PrintErrorFull("", err)
+        return nil, err
+    }
+    if owner.Validated == true {
+        owner.Validated = false
+        owner.addAudit("revoke", args[1])
+        if err = owner.save(stub); err != nil {
+            utils.PrintErrorFull("revokeOwnerValidation - save", err)
+            return nil, err
+        }
+        recordEvent(stub, EVENTOWNERVALIDATIONREVOKED, ownerId, map[string]string{ "reason": args[1] })
+    }
+    utils.PrintSuccess("Revoked the validation of owner " + ownerId)
+    result := newInvokeResult(fn, ownerId, "Unvalidated")
+    return result.toBytes()
+} // end of dcc.revokeOwnerValidation
+
+
+// Admin function. Freezing stops an owner from trading and issuing until it is unfrozen.
+func (dcc *DecodedChainCode) freezeOwner(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
+    var err error
+    ownerId := args[0]
+    owner, err := dcc.getOwner(stub, []string{ ownerId })
+    if err != nil {
+        utils.PrintErrorFull("freezeOwner - getOwner", err)
+        return nil, err
+    }
+    if owner.Closed == true {
+        err = newChaincodeError(ERROWNERCLOSED, fn, "Owner " + ownerId + " is closed").withDetail("ownerId", ownerId)
+        utils.PrintErrorFull("", err)
+        return nil, err
+    }
+    // Freezing a frozen owner changes nothing.
+    if owner.Frozen == false {
+        owner.Frozen = true
+        owner.addAudit("freeze", args[1])
+        if err = owner.save(stub); err != nil {
+            utils.PrintErrorFull("freezeOwner - save", err)
+            return nil, err
+        }
+        recordEvent(stub, EVENTOWNERFROZEN, ownerId, map[string]string{ "reason": args[1] })
+    }
+    utils.PrintSuccess("Froze owner " + ownerId)
+    result := newInvokeResult(fn, ownerId, "Frozen")
+    return result.toBytes()
+} // end of dcc.freezeOwner
+
+
+// Admin function.
+func (dcc *DecodedChainCode) unfreezeOwner(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
+    var err error
+    ownerId := args[0]
+    owner, err := dcc.getOwner(stub, []string{ ownerId })
+    if err != nil {
+        utils.PrintErrorFull("unfreezeOwner - getOwner", err)
+        return nil, err
+    }
+    if owner.Closed == true {
+        err = newChaincodeError(ERROWNERCLOSED, fn, "Owner " + ownerId + " is closed").withDetail("ownerId", ownerId)
+        utils.PrintErrorFull("", err)
+        return nil, err
+    }
+    if owner.Frozen == true {
+        owner.Frozen = false
+        owner.addAudit("unfreeze", args[1])
+        if err = owner.save(stub); err != nil {
+            utils.PrintErrorFull("unfreezeOwner - save", err)
+            return nil, err
+        }
+        recordEvent(stub, EVENTOWNERUNFROZEN, ownerId, map[string]string{ "reason": args[1] })
+    }
+    utils.PrintSuccess("Unfroze owner " + ownerId)
+    result := newInvokeResult(fn, ownerId, "Active")
+    return result.toBytes()
+} // end of dcc.unfreezeOwner
+
+
+// Admin function. The owner record stays in state so its history remains readable,
+// it is only removed from the Owners ledger.
+func (dcc *DecodedChainCode) closeOwner(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
+    var err error
+    ownerId := args[0]
+    owner, err := dcc.getOwner(stub, []string{ ownerId })
+    if err != nil {
+        utils.PrintErrorFull("closeOwner - getOwner", err)
+        return nil, err
+    }
+    if owner.Closed == true {
+        err = newChaincodeError(ERROWNERCLOSED, fn, "Owner " + ownerId + " is already closed").withDetail("ownerId", ownerId)
+        utils.PrintErrorFull("", err)
+        return nil, err
+    }
+    if err = owner.verifyClosable(fn); err != nil {
+        utils.PrintErrorFull("closeOwner - verifyClosable", err)
+        return nil, err
+    }
+    owner.Closed = true
+    owner.addAudit("close", args[1])
     if err = owner.save(stub); err != nil {
-        utils.PrintErrorFull("changeOwnerValidationStatus - save", err)
+        utils.PrintErrorFull("closeOwner - save", err)
         return nil, err
     }
-    utils.PrintSuccess("Changed the owner validation status for " + ownerId)
-    return nil, nil
-} // end of dcc.changeOwnerValidationStatus
+    // Remove the owner from the ledger of owners.
+    if err = dcc.removeFromLedger(stub, PRIMARYKEY[0], ownerId); err != nil {
+        utils.PrintErrorFull("closeOwner - removeFromLedger", err)
+        return nil, err
+    }
+    recordEvent(stub, EVENTOWNERCLOSED, ownerId, map[string]string{ "reason": args[1] })
+    utils.PrintSuccess("Closed owner " + ownerId)
+    result := newInvokeResult(fn, ownerId, "Closed")
+    return result.toBytes()
+} // end of dcc.closeOwner
 
 
 // ============================================================================================================================
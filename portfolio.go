@@ -0,0 +1,115 @@
+/*
+
+DECODED HYPERLEDGER APPLICATION
+
+The portfolio of an owner joins its asset ids with the quantities held in each asset and values them at the
+current asset price:
+    - Holdings: quantity, quantity in escrow for pending sales, price and market value per asset.
+    - Cash: the balance and the funds in escrow for pending purchases.
+    - Total: cash, escrow and the market value of all holdings.
+
+DecodedChainCode functions:
+- getPortfolio - private function
+- readPortfolio
+
+*/
+
+
+package main
+
+
+import (
+    "encoding/json"
+    "sort"
+
+    "github.com/hyperledger/fabric/core/chaincode/shim"
+
+    utils "github.com/DecodedCo/blockchain-marketplace-chaincode/utils"
+)
+
+
+// ============================================================================================================================
+
+
+type Holding struct {
+    AssetId     string              `json:"assetId"`
+    AssetName   string              `json:"assetName"`
+    Quantity    int                 `json:"quantity"`
+    EscrowQty   int                 `json:"escrowQty"` // Still owned until the pending sale is approved.
+    Price       float64             `json:"price"`
+    MarketValue float64             `json:"marketValue"` // (Quantity + EscrowQty) * Price
+}
+
+
+type Portfolio struct {
+    OwnerId         string          `json:"ownerId"`
+    Holdings        []Holding       `json:"holdings"`
+    Balance         float64         `json:"balance"`
+    EscrowBalance   float64         `json:"escrowBalance"`
+    HoldingsValue   float64         `json:"holdingsValue"`
+    Total           float64         `json:"total"`
+}
+
+
+// Sorts holdings by asset id.
+type holdingsByAsset []Holding
+
+func (h holdingsByAsset) Len() int { return len(h) }
+func (h holdingsByAsset) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h holdingsByAsset) Less(i, j int) bool { return h[i].AssetId < h[j].AssetId }
+
+
+// ============================================================================================================================
+
+
+func (dcc *DecodedChainCode) getPortfolio(stub shim.ChaincodeStubInterface, ownerId string) (Portfolio, error) {
+    var err error
+    portfolio := Portfolio{ OwnerId: ownerId, Holdings: []Holding{} }
+    owner, err := dcc.getOwner(stub, []string{ ownerId })
+    if err != nil {
+        return portfolio, err
+    }
+    for _, assetId := range owner.Assets {
+        asset, err := dcc.getAsset(stub, []string{ assetId })
+        if err != nil {
+            return portfolio, err
+        }
+        ownedBy := asset.OwnedBy[ownerId]
+        holding := Holding{
+            AssetId: asset.Id,
+            AssetName: asset.Name,
+            Quantity: ownedBy.Quantity,
+            EscrowQty: ownedBy.EscrowQty,
+            Price: asset.Price,
+            MarketValue: float64(ownedBy.Quantity + ownedBy.EscrowQty) * asset.Price,
+        }
+        portfolio.Holdings = append(portfolio.Holdings, holding)
+        portfolio.HoldingsValue = portfolio.HoldingsValue + holding.MarketValue
+    }
+    sort.Sort(holdingsByAsset(portfolio.Holdings))
+    portfolio.Balance = owner.Balance
+    portfolio.EscrowBalance = owner.EscrowBalance
+    portfolio.Total = portfolio.Balance + portfolio.EscrowBalance + portfolio.HoldingsValue
+    return portfolio, nil
+} // end of dcc.getPortfolio
+
+
+// Returns the holdings, cash and total value of an owner.
+func (dcc *DecodedChainCode) readPortfolio(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
+    var err error
+    portfolio, err := dcc.getPortfolio(stub, args[0])
+    if err != nil {
+        utils.PrintErrorFull("readPortfolio - getPortfolio", err)
+        return nil, err
+    }
+    portfolioBytes, err := json.Marshal(&portfolio)
+    if err != nil {
+        utils.PrintErrorFull("readPortfolio - Marshal", err)
+        return nil, err
+    }
+    utils.PrintSuccess("Retrieved the portfolio of owner " + args[0])
+    return portfolioBytes, nil
+} // end of dcc.readPortfolio
+
+
+// ============================================================================================================================
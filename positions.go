@@ -0,0 +1,352 @@
+/*
+
+DECODED HYPERLEDGER APPLICATION
+
+Cost basis and profit and loss. Every settled trade (validated straight away or approved later) adds a lot to
+the buyer's position in the asset and takes the sold units off the seller's position:
+    - FIFO: the oldest lots are sold first.
+    - AVERAGE: the sold units cost the average of all held units, the rest is kept as a single lot at that average.
+The method is set by an admin with `setCostBasisMethod` and defaults to FIFO.
+
+Units that were never bought through a trade (issued units and units held before the positions were tracked)
+have no lot and a cost of zero. With FIFO they are sold first.
+
+DecodedChainCode functions:
+- getCostBasisMethod - private function
+- getPositions - private function
+- updatePositions - private function
+- setCostBasisMethod
+- readProfitAndLoss
+
+Positions functions:
+- save
+
+Position functions:
+- lotQuantity
+- lotCost
+- buy
+- sell
+
+*/
+
+
+package main
+
+
+import (
+    "encoding/json"
+    "sort"
+
+    "github.com/hyperledger/fabric/core/chaincode/shim"
+
+    utils "github.com/DecodedCo/blockchain-marketplace-chaincode/utils"
+)
+
+
+// ============================================================================================================================
+
+
+// The state key the cost basis method is stored under.
+const COSTBASISKEY = "CostBasisMethod"
+
+var COSTBASISMETHODS = []string{ "FIFO", "AVERAGE" }
+
+
+type Lot struct {
+    TransactionId   string          `json:"transactionId"`
+    Quantity        int             `json:"quantity"`
+    Price           float64         `json:"price"`
+    Acquired        int64           `json:"acquired"`
+}
+
+
+type Position struct {
+    AssetId         string          `json:"assetId"`
+    Lots            []Lot           `json:"lots"` // Oldest first.
+    Realised        float64         `json:"realised"`
+}
+
+
+// All positions of an owner, stored under one key.
+type Positions struct {
+    OwnerId         string              `json:"ownerId"`
+    Assets          map[string]Position `json:"assets"`
+}
+
+
+type PositionPnL struct {
+    AssetId         string          `json:"assetId"`
+    Quantity        int             `json:"quantity"` // Held, including the quantity in escrow.
+    CostBasis       float64         `json:"costBasis"`
+    AverageCost     float64         `json:"averageCost"`
+    Price           float64         `json:"price"`
+    MarketValue     float64         `json:"marketValue"`
+    Unrealised      float64         `json:"unrealised"`
+    Realised        float64         `json:"realised"`
+}
+
+
+type ProfitAndLoss struct {
+    OwnerId         string          `json:"ownerId"`
+    Method          string          `json:"method"`
+    Positions       []PositionPnL   `json:"positions"`
+    Unrealised      float64         `json:"unrealised"`
+    Realised        float64         `json:"realised"`
+}
+
+
+// Sorts positions by asset id.
+type positionsByAsset []PositionPnL
+
+func (p positionsByAsset) Len() int { return len(p) }
+func (p positionsByAsset) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p positionsByAsset) Less(i, j int) bool { return p[i].AssetId < p[j].AssetId }
+
+
+// ============================================================================================================================
+
+
+func (ps *Positions) save(stub shim.ChaincodeStubInterface) (error) {
+    var err error
+    positionsBytesToWrite, err := json.Marshal(&ps)
+    if err != nil {
+        utils.PrintErrorFull("save - Marshal", err)
+        return err
+    }
+    if err = stub.PutState(positionKey(ps.OwnerId), positionsBytesToWrite); err != nil {
+        utils.PrintErrorFull("save - PutState", err)
+        return err
+    }
+    return nil
+} // end of ps.save
+
+
+// ============================================================================================================================
+
+
+func (p *Position) lotQuantity() (int) {
+    quantity := 0
+    for _, lot := range p.Lots {
+        quantity = quantity + lot.Quantity
+    }
+    return quantity
+} // end of p.lotQuantity
+
+
+func (p *Position) lotCost() (float64) {
+    cost := 0.0
+    for _, lot := range p.Lots {
+        cost = cost + float64(lot.Quantity) * lot.Price
+    }
+    return cost
+} // end of p.lotCost
+
+
+func (p *Position) buy(transactionId string, quantity int, price float64, timestamp int64) {
+    p.Lots = append(p.Lots, Lot{ TransactionId: transactionId, Quantity: quantity, Price: price, Acquired: timestamp })
+} // end of p.buy
+
+
+// Takes the sold units off the position and returns the realised profit of the sale.
+// heldBefore is the quantity held before the sale, including the units without a lot.
+func (p *Position) sell(method string, quantity int, price float64, heldBefore int, timestamp int64) (float64) {
+    untracked := heldBefore - p.lotQuantity()
+    if untracked < 0 {
+        untracked = 0
+    }
+    cost := 0.0
+    if method == "AVERAGE" {
+        averageCost := 0.0
+        if heldBefore > 0 {
+            averageCost = p.lotCost() / float64(heldBefore)
+        }
+        cost = averageCost * float64(quantity)
+        p.Lots = []Lot{}
+        if heldBefore > quantity {
+            p.Lots = append(p.Lots, Lot{ TransactionId: "", Quantity: heldBefore - quantity, Price: averageCost, Acquired: timestamp })
+        }
+    } else {
+        // Units without a lot are the oldest.
+        remaining := quantity - untracked
+        lots := []Lot{}
+        for _, lot := range p.Lots {
+            if remaining > 0 {
+                sold := lot.Quantity
+                if remaining < sold {
+                    sold = remaining
+                }
+                cost = cost + float64(sold) * lot.Price
+                lot.Quantity = lot.Quantity - sold
+                remaining = remaining - sold
+            }
+            if lot.Quantity > 0 {
+                lots = append(lots, lot)
+            }
+        }
+        p.Lots = lots
+    }
+    realised := price * float64(quantity) - cost
+    p.Realised = p.Realised + realised
+    return realised
+} // end of p.sell
+
+
+// ============================================================================================================================
+
+
+func (dcc *DecodedChainCode) getCostBasisMethod(stub shim.ChaincodeStubInterface) (string, error) {
+    var err error
+    methodBytes, err := stub.GetState(systemKey(COSTBASISKEY))
+    if err != nil {
+        return "", err
+    }
+    if methodBytes == nil {
+        return COSTBASISMETHODS[0], nil
+    }
+    return string(methodBytes), nil
+} // end of dcc.getCostBasisMethod
+
+
+// Owners without positions yet get an empty set.
+func (dcc *DecodedChainCode) getPositions(stub shim.ChaincodeStubInterface, ownerId string) (Positions, error) {
+    var err error
+    positions := Positions{ OwnerId: ownerId, Assets: make(map[string]Position) }
+    positionsBytes, err := stub.GetState(positionKey(ownerId))
+    if err != nil {
+        return positions, err
+    }
+    if positionsBytes == nil {
+        return positions, nil
+    }
+    if err = json.Unmarshal(positionsBytes, &positions); err != nil {
+        return positions, err
+    }
+    if positions.Assets == nil {
+        positions.Assets = make(map[string]Position)
+    }
+    return positions, nil
+} // end of dcc.getPositions
+
+
+// Settles a trade on the positions of both counterparties. Runs after the asset holdings are saved.
+func (dcc *DecodedChainCode) updatePositions(stub shim.ChaincodeStubInterface, transaction Transaction) (error) {
+    var err error
+    method, err := dcc.getCostBasisMethod(stub)
+    if err != nil {
+        return err
+    }
+    asset, err := dcc.getAsset(stub, []string{ transaction.AssetId })
+    if err != nil {
+        return err
+    }
+    // Seller
+    sellerPositions, err := dcc.getPositions(stub, transaction.SellerId)
+    if err != nil {
+        return err
+    }
+    sellerPosition := sellerPositions.Assets[transaction.AssetId]
+    sellerPosition.AssetId = transaction.AssetId
+    heldBefore := asset.OwnedBy[transaction.SellerId].Quantity + asset.OwnedBy[transaction.SellerId].EscrowQty + transaction.Quantity
+    sellerPosition.sell(method, transaction.Quantity, transaction.Price, heldBefore, transaction.Created)
+    sellerPositions.Assets[transaction.AssetId] = sellerPosition
+    if err = sellerPositions.save(stub); err != nil {
+        return err
+    }
+    // Buyer
+    buyerPositions, err := dcc.getPositions(stub, transaction.BuyerId)
+    if err != nil {
+        return err
+    }
+    buyerPosition := buyerPositions.Assets[transaction.AssetId]
+    buyerPosition.AssetId = transaction.AssetId
+    buyerPosition.buy(transaction.Id, transaction.Quantity, transaction.Price, transaction.Created)
+    buyerPositions.Assets[transaction.AssetId] = buyerPosition
+    if err = buyerPositions.save(stub); err != nil {
+        return err
+    }
+    return nil
+} // end of dcc.updatePositions
+
+
+// Admin function. Applies to the sales settled from now on.
+func (dcc *DecodedChainCode) setCostBasisMethod(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
+    var err error
+    if utils.IsElementInSlice(COSTBASISMETHODS, args[0]) == false {
+        err = newChaincodeError(ERRINVALIDARGUMENTS, fn, "Unknown cost basis method " + args[0]).withDetail("method", "must be FIFO or AVERAGE")
+        utils.PrintErrorFull("", err)
+        return nil, err
+    }
+    if err = stub.PutState(systemKey(COSTBASISKEY), []byte(args[0])); err != nil {
+        utils.PrintErrorFull("setCostBasisMethod - PutState", err)
+        return nil, err
+    }
+    recordEvent(stub, EVENTCOSTBASISMETHODSET, "", map[string]string{ "method": args[0] })
+    utils.PrintSuccess("Set the cost basis method to " + args[0])
+    result := newInvokeResult(fn, "", "Set")
+    return result.toBytes()
+} // end of dcc.setCostBasisMethod
+
+
+// Returns the cost basis, realised and unrealised profit of every position of an owner, valued at the current asset price.
+func (dcc *DecodedChainCode) readProfitAndLoss(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
+    var err error
+    ownerId := args[0]
+    owner, err := dcc.getOwner(stub, []string{ ownerId })
+    if err != nil {
+        utils.PrintErrorFull("readProfitAndLoss - getOwner", err)
+        return nil, err
+    }
+    positions, err := dcc.getPositions(stub, ownerId)
+    if err != nil {
+        utils.PrintErrorFull("readProfitAndLoss - getPositions", err)
+        return nil, err
+    }
+    method, err := dcc.getCostBasisMethod(stub)
+    if err != nil {
+        utils.PrintErrorFull("readProfitAndLoss - getCostBasisMethod", err)
+        return nil, err
+    }
+    // Held assets, and assets that were sold out but have realised a profit or loss.
+    assetIds := owner.Assets
+    for assetId := range positions.Assets {
+        if utils.IsElementInSlice(assetIds, assetId) == false {
+            assetIds = append(assetIds, assetId)
+        }
+    }
+    pnl := ProfitAndLoss{ OwnerId: ownerId, Method: method, Positions: []PositionPnL{} }
+    for _, assetId := range assetIds {
+        asset, err := dcc.getAsset(stub, []string{ assetId })
+        if err != nil {
+            utils.PrintErrorFull("readProfitAndLoss - getAsset", err)
+            return nil, err
+        }
+        position := positions.Assets[assetId]
+        held := asset.OwnedBy[ownerId].Quantity + asset.OwnedBy[ownerId].EscrowQty
+        positionPnL := PositionPnL{
+            AssetId: assetId,
+            Quantity: held,
+            CostBasis: position.lotCost(),
+            Price: asset.Price,
+            MarketValue: float64(held) * asset.Price,
+            Realised: position.Realised,
+        }
+        if held > 0 {
+            positionPnL.AverageCost = positionPnL.CostBasis / float64(held)
+        }
+        positionPnL.Unrealised = positionPnL.MarketValue - positionPnL.CostBasis
+        pnl.Positions = append(pnl.Positions, positionPnL)
+        pnl.Unrealised = pnl.Unrealised + positionPnL.Unrealised
+        pnl.Realised = pnl.Realised + positionPnL.Realised
+    }
+    sort.Sort(positionsByAsset(pnl.Positions))
+    pnlBytes, err := json.Marshal(&pnl)
+    if err != nil {
+        utils.PrintErrorFull("readProfitAndLoss - Marshal", err)
+        return nil, err
+    }
+    utils.PrintSuccess("Retrieved the profit and loss of owner " + ownerId)
+    return pnlBytes, nil
+} // end of dcc.readProfitAndLoss
+
+
+// ============================================================================================================================
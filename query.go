@@ -0,0 +1,217 @@
+/*
+
+DECODED HYPERLEDGER APPLICATION
+
+Paginated and filtered reads of the ledgers. The list queries take an optional JSON-encoded argument:
+
+    {"pageSize":50, "pageToken":"...", "tag":"...", "issuer":"...", "status":"...", "owner":"...", "approver":"...", "from":0, "to":0}
+
+and return a page of records with the token to request the next page with. The token is empty on the last page.
+
+    {"items":[...], "nextPageToken":"..."}
+
+The token holds the id the next page starts after and a fingerprint of the function and filters it was returned
+for. It is refused with other filters or by another function, so a page can never continue a different listing.
+The page size can change between pages. The token is not encrypted; clients pass it back as they received it.
+
+DecodedChainCode functions:
+- parseListQuery - private function
+- parsePageToken - private function
+- readPage - private function
+
+ListQuery functions:
+- inDateRange
+- fingerprint
+
+*/
+
+
+package main
+
+
+import (
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "strconv"
+
+    "github.com/hyperledger/fabric/core/chaincode/shim"
+
+    utils "github.com/DecodedCo/blockchain-marketplace-chaincode/utils"
+)
+
+
+// ============================================================================================================================
+
+
+const DEFAULTPAGESIZE = 50
+const MAXPAGESIZE = 500
+// A page stops after this many scanned entries per requested item, so a selective filter cannot time out the query.
+const SCANFACTOR = 10
+
+
+type ListQuery struct {
+    PageSize    int                 `json:"pageSize"`
+    PageToken   string              `json:"pageToken"`
+    Tag         string              `json:"tag"`
+    Issuer      string              `json:"issuer"`
+    Status      string              `json:"status"`
+    Owner       string              `json:"owner"`
+    Approver    string              `json:"approver"`
+    From        int64               `json:"from"` // unix timestamp, inclusive
+    To          int64               `json:"to"` // unix timestamp, exclusive
+    // Set by parseListQuery.
+    function    string
+    after       string
+}
+
+
+type PageToken struct {
+    Query       string              `json:"query"` // The fingerprint of the query.
+    After       string              `json:"after"` // The id of the last scanned entry.
+}
+
+
+type Page struct {
+    Items       []interface{}       `json:"items"`
+    NextToken   string              `json:"nextPageToken"`
+}
+
+
+// ============================================================================================================================
+
+
+// A zero From or To leaves that side of the range open.
+func (q *ListQuery) inDateRange(timestamp int64) (bool) {
+    if q.From != 0 && timestamp < q.From {
+        return false
+    }
+    if q.To != 0 && timestamp >= q.To {
+        return false
+    }
+    return true
+} // end of q.inDateRange
+
+
+// Identifies the function and filters of a query. The page size and token are left out.
+func (q *ListQuery) fingerprint() (string) {
+    filters := *q
+    filters.PageSize = 0
+    filters.PageToken = ""
+    filtersBytes, _ := json.Marshal(&filters)
+    hash := sha256.Sum256(append([]byte(q.function + "\x00"), filtersBytes...))
+    return hex.EncodeToString(hash[:8])
+} // end of q.fingerprint
+
+
+// ============================================================================================================================
+
+
+// Parses the optional query argument. Filters the function does not support are reported as field errors.
+func (dcc *DecodedChainCode) parseListQuery(fn string, args []string, supportedFilters []string) (ListQuery, error) {
+    var err error
+    var query ListQuery
+    if len(args) > 1 {
+        err = argumentCountError(fn)
+        return query, err
+    }
+    if len(args) == 1 {
+        if err = dcc.decodeJSONArgument(fn, args, &query); err != nil {
+            return query, err
+        }
+    }
+    fieldErrors := FieldErrors{}
+    filters := map[string]bool{
+        "tag": query.Tag != "",
+        "issuer": query.Issuer != "",
+        "status": query.Status != "",
+        "owner": query.Owner != "",
+        "approver": query.Approver != "",
+        "from": query.From != 0,
+        "to": query.To != 0,
+    }
+    for filter, isSet := range filters {
+        if isSet && utils.IsElementInSlice(supportedFilters, filter) == false {
+            fieldErrors[filter] = "is not a filter of " + fn
+        }
+    }
+    if query.PageSize == 0 {
+        query.PageSize = DEFAULTPAGESIZE
+    }
+    if query.PageSize < 0 || query.PageSize > MAXPAGESIZE {
+        fieldErrors["pageSize"] = "must be between 1 and " + strconv.Itoa(MAXPAGESIZE)
+    }
+    query.function = fn
+    if query.PageToken != "" {
+        var problem string
+        if query.after, problem = dcc.parsePageToken(query); problem != "" {
+            fieldErrors["pageToken"] = problem
+        }
+    }
+    return query, fieldErrors.toError(fn)
+} // end of dcc.parseListQuery
+
+
+// Returns the id the page starts after, or what is wrong with the token.
+func (dcc *DecodedChainCode) parsePageToken(query ListQuery) (string, string) {
+    var token PageToken
+    tokenBytes, err := base64.URLEncoding.DecodeString(query.PageToken)
+    if err != nil || json.Unmarshal(tokenBytes, &token) != nil || token.After == "" {
+        return "", "is not a valid page token"
+    }
+    if token.Query != query.fingerprint() {
+        return "", "belongs to another query"
+    }
+    return token.After, ""
+} // end of dcc.parsePageToken
+
+
+// Reads one page of a ledger. The match function loads the record of an id and returns nil if it is filtered out.
+// The page token holds the id of the last scanned entry; the next page starts right after it.
+func (dcc *DecodedChainCode) readPage(stub shim.ChaincodeStubInterface, ledgerName string, query ListQuery, match func(id string) (interface{}, error)) (Page, error) {
+    var err error
+    page := Page{ Items: []interface{}{}, NextToken: "" }
+    startKey, endKey := prefixRange(ledgerEntryPrefix(ledgerName))
+    if query.after != "" {
+        startKey = ledgerEntryKey(ledgerName, query.after) + "\x00"
+    }
+    iterator, err := stub.RangeQueryState(startKey, endKey)
+    if err != nil {
+        return page, err
+    }
+    defer iterator.Close()
+    scanned := 0
+    lastId := ""
+    for iterator.HasNext() {
+        if len(page.Items) == query.PageSize || scanned == query.PageSize * SCANFACTOR {
+            break
+        }
+        _, idBytes, err := iterator.Next()
+        if err != nil {
+            return page, err
+        }
+        scanned = scanned + 1
+        item, err := match(string(idBytes))
+        if err != nil {
+            return page, err
+        }
+        if item != nil {
+            page.Items = append(page.Items, item)
+        }
+        lastId = string(idBytes)
+    }
+    // Nothing left to read.
+    if iterator.HasNext() == false || lastId == "" {
+        return page, nil
+    }
+    tokenBytes, err := json.Marshal(&PageToken{ Query: query.fingerprint(), After: lastId })
+    if err != nil {
+        return page, err
+    }
+    page.NextToken = base64.URLEncoding.EncodeToString(tokenBytes)
+    return page, nil
+} // end of dcc.readPage
+
+
+// ============================================================================================================================
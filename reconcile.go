@@ -0,0 +1,221 @@
+/*
+
+DECODED HYPERLEDGER APPLICATION
+
+Repairs the owner side of the ownership bookkeeping from the asset side, for when `checkInvariants` finds them apart:
+    - Owner.Assets is rebuilt from the holdings in Asset.OwnedBy.
+    - Owner.Issued is rebuilt from Asset.Issuer.
+    - Owner.EscrowBalance is recomputed from the PendingTransactions ledger.
+Every run is recorded in the repair log with each change it made, and each changed owner gets an audit entry.
+
+    repair:<repairId>
+    ledger:Repairs:<repairId>
+
+DecodedChainCode functions:
+- reconcileOwnership
+- readRepairLog
+
+Functions:
+- reconcileIds
+
+*/
+
+
+package main
+
+
+import (
+    "encoding/json"
+    "fmt"
+    "math"
+    "strconv"
+    "time"
+
+    "github.com/hyperledger/fabric/core/chaincode/shim"
+
+    utils "github.com/DecodedCo/blockchain-marketplace-chaincode/utils"
+)
+
+
+// ============================================================================================================================
+
+
+const REPAIRLEDGER = "Repairs"
+
+
+type RepairChange struct {
+    OwnerId     string              `json:"ownerId"`
+    Field       string              `json:"field"`
+    Before      string              `json:"before"`
+    After       string              `json:"after"`
+}
+
+
+type Repair struct {
+    Id          string              `json:"repairId"`
+    Timestamp   int64               `json:"timestamp"`
+    Changes     []RepairChange      `json:"changes"`
+    Remaining   []Violation         `json:"remainingViolations"` // What reconciling could not fix.
+}
+
+
+func repairKey(repairId string) (string) {
+    return ENTITYPREFIX["repair"] + repairId
+}
+
+
+// ============================================================================================================================
+
+
+// Keeps the ids that are still expected in their current order and appends the missing ones sorted.
+func reconcileIds(current []string, expected map[string]bool) ([]string) {
+    ids := []string{}
+    for _, id := range current {
+        if expected[id] && utils.IsElementInSlice(ids, id) == false {
+            ids = append(ids, id)
+        }
+    }
+    for _, id := range sortedKeys(expected) {
+        if utils.IsElementInSlice(ids, id) == false {
+            ids = append(ids, id)
+        }
+    }
+    return ids
+}
+
+
+// ============================================================================================================================
+
+
+// Admin function. Returns the repair log entry of the run.
+func (dcc *DecodedChainCode) reconcileOwnership(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
+    var err error
+    var emptyArgs []string
+    data, err := dcc.loadLedgerData(stub)
+    if err != nil {
+        utils.PrintErrorFull("reconcileOwnership - loadLedgerData", err)
+        return nil, err
+    }
+    // What the asset side and the pending ledger say.
+    holdings := make(map[string]map[string]bool) // ownerId -> assetIds
+    issued := make(map[string]map[string]bool) // ownerId -> assetIds
+    escrow := make(map[string]float64) // ownerId -> amount
+    for ownerId := range data.Owners {
+        holdings[ownerId] = make(map[string]bool)
+        issued[ownerId] = make(map[string]bool)
+    }
+    for assetId, asset := range data.Assets {
+        for ownerId, ownedBy := range asset.OwnedBy {
+            if holdings[ownerId] != nil && ownedBy.Quantity + ownedBy.EscrowQty > 0 {
+                holdings[ownerId][assetId] = true
+            }
+        }
+        if issued[asset.Issuer] != nil {
+            issued[asset.Issuer][assetId] = true
+        }
+    }
+    for _, transactionId := range data.Ledgers[PRIMARYKEY[3]] {
+        transaction, ok := data.Transactions[transactionId]
+        if ok && transaction.Status == "Pending" {
+            escrow[transaction.BuyerId] = escrow[transaction.BuyerId] + transaction.escrowedAmount()
+        }
+    }
+    // Bring every owner in line.
+    repair := Repair{ Timestamp: time.Now().Unix(), Changes: []RepairChange{} }
+    ownerIds := make(map[string]bool)
+    for ownerId := range data.Owners {
+        ownerIds[ownerId] = true
+    }
+    for _, ownerId := range sortedKeys(ownerIds) {
+        owner := data.Owners[ownerId]
+        changes := []RepairChange{}
+        assets := reconcileIds(owner.Assets, holdings[ownerId])
+        if fmt.Sprint(assets) != fmt.Sprint(owner.Assets) {
+            changes = append(changes, RepairChange{ OwnerId: ownerId, Field: "assetIds", Before: fmt.Sprint(owner.Assets), After: fmt.Sprint(assets) })
+            owner.Assets = assets
+        }
+        issuedIds := reconcileIds(owner.Issued, issued[ownerId])
+        if fmt.Sprint(issuedIds) != fmt.Sprint(owner.Issued) {
+            changes = append(changes, RepairChange{ OwnerId: ownerId, Field: "issuedIds", Before: fmt.Sprint(owner.Issued), After: fmt.Sprint(issuedIds) })
+            owner.Issued = issuedIds
+        }
+        if math.Abs(owner.EscrowBalance - escrow[ownerId]) > BALANCETOLERANCE {
+            changes = append(changes, RepairChange{ OwnerId: ownerId, Field: "escrowBalance", Before: formatAmount(owner.EscrowBalance), After: formatAmount(escrow[ownerId]) })
+            owner.EscrowBalance = escrow[ownerId]
+        }
+        if len(changes) == 0 {
+            continue
+        }
+        owner.addAudit("reconcile", strconv.Itoa(len(changes)) + " fields repaired")
+        owner.Version = owner.Version + 1
+        if err = owner.save(stub); err != nil {
+            utils.PrintErrorFull("reconcileOwnership - save", err)
+            return nil, err
+        }
+        data.Owners[ownerId] = owner
+        repair.Changes = append(repair.Changes, changes...)
+    }
+    repair.Remaining = verifyInvariants(data)
+    // Record the run. Repair ids count up so the log reads in order.
+    repairIds, err := dcc.getDataArrayStrings(stub, REPAIRLEDGER, emptyArgs)
+    if err != nil {
+        utils.PrintErrorFull("reconcileOwnership - getDataArrayStrings", err)
+        return nil, err
+    }
+    repair.Id = fmt.Sprintf("%08d", len(repairIds) + 1)
+    repairBytes, err := json.Marshal(&repair)
+    if err != nil {
+        utils.PrintErrorFull("reconcileOwnership - Marshal", err)
+        return nil, err
+    }
+    if err = stub.PutState(repairKey(repair.Id), repairBytes); err != nil {
+        utils.PrintErrorFull("reconcileOwnership - PutState", err)
+        return nil, err
+    }
+    if err = dcc.addToLedger(stub, REPAIRLEDGER, repair.Id); err != nil {
+        utils.PrintErrorFull("reconcileOwnership - addToLedger", err)
+        return nil, err
+    }
+    recordEvent(stub, EVENTOWNERSHIPRECONCILED, "", map[string]string{ "repairId": repair.Id, "changes": strconv.Itoa(len(repair.Changes)) })
+    utils.PrintSuccess("Reconciled the ownership: " + strconv.Itoa(len(repair.Changes)) + " changes.")
+    return repairBytes, nil
+} // end of dcc.reconcileOwnership
+
+
+// Function to read a page of the repair log, oldest first. Optional JSON argument, see query.go. Filters: from and to.
+func (dcc *DecodedChainCode) readRepairLog(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
+    var err error
+    query, err := dcc.parseListQuery(fn, args, []string{ "from", "to" })
+    if err != nil {
+        utils.PrintErrorFull("readRepairLog - parseListQuery", err)
+        return nil, err
+    }
+    page, err := dcc.readPage(stub, REPAIRLEDGER, query, func(repairId string) (interface{}, error) {
+        var repair Repair
+        repairBytes, err := stub.GetState(repairKey(repairId))
+        if err != nil {
+            return nil, err
+        }
+        if err = json.Unmarshal(repairBytes, &repair); err != nil {
+            return nil, err
+        }
+        if query.inDateRange(repair.Timestamp) == false {
+            return nil, nil
+        }
+        return repair, nil
+    })
+    if err != nil {
+        utils.PrintErrorFull("readRepairLog - readPage", err)
+        return nil, err
+    }
+    pageBytes, err := json.Marshal(&page)
+    if err != nil {
+        utils.PrintErrorFull("readRepairLog - Marshal", err)
+        return nil, err
+    }
+    utils.PrintSuccess("Retrieved a page of the repair log.")
+    return pageBytes, nil
+} // end of dcc.readRepairLog
+
+
+// ============================================================================================================================
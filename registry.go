@@ -0,0 +1,336 @@
+/*
+
+DECODED HYPERLEDGER APPLICATION
+
+The function registry. Every invoke and query is registered once with:
+    - mutates: whether it changes state. Functions that mutate can only be invoked, the others only queried.
+    - role: who may call it, "any" or "admin".
+    - args: the positional arguments with their type. Optional arguments follow the required ones, and the last
+      argument can be variadic, repeating as often as needed.
+
+Invoke and Query look the function up and check the role, the number of arguments and their types before the
+handler runs, so the handlers only check what the schema cannot express. listFunctions returns the registry.
+
+Argument types: string, int, float, bool, json. An argument with values only accepts one of them, and a
+non-negative number argument refuses numbers below zero.
+
+Functions:
+- lookupFunction
+
+FunctionSpec functions:
+- validateArgs
+
+DecodedChainCode functions:
+- dispatch - private function
+- listFunctions
+
+*/
+
+
+package main
+
+
+import (
+    "encoding/json"
+    "strconv"
+
+    "github.com/hyperledger/fabric/core/chaincode/shim"
+
+    utils "github.com/DecodedCo/blockchain-marketplace-chaincode/utils"
+)
+
+
+// ============================================================================================================================
+
+
+// Roles a function can require. ADMINROLE is the admin role.
+const ROLEANY = "any"
+
+// Argument types.
+const (
+    ARGSTRING   = "string"
+    ARGINT      = "int"
+    ARGFLOAT    = "float"
+    ARGBOOL     = "bool"
+    ARGJSON     = "json"
+)
+
+
+type ArgumentSpec struct {
+    Name        string      `json:"name"`
+    Type        string      `json:"type"`
+    Optional    bool        `json:"optional,omitempty"`
+    Variadic    bool        `json:"variadic,omitempty"`
+    Values      []string    `json:"values,omitempty"`
+    NonNegative bool        `json:"nonNegative,omitempty"`
+}
+
+
+type FunctionSpec struct {
+    Name        string          `json:"name"`
+    Mutates     bool            `json:"mutates"`
+    Role        string          `json:"role"`
+    Args        []ArgumentSpec  `json:"args"`
+    Description string          `json:"description"`
+    handler     func(*DecodedChainCode, shim.ChaincodeStubInterface, string, []string) ([]byte, error)
+}
+
+
+// Filled in init, as listFunctions reads the registry itself.
+var FUNCTIONS []FunctionSpec
+
+
+func init() {
+    ownerId := ArgumentSpec{ Name: "ownerId", Type: ARGSTRING }
+    assetId := ArgumentSpec{ Name: "assetId", Type: ARGSTRING }
+    transactionId := ArgumentSpec{ Name: "transactionId", Type: ARGSTRING }
+    version := ArgumentSpec{ Name: "version", Type: ARGINT }
+    fieldValuePairs := ArgumentSpec{ Name: "fieldValuePairs", Type: ARGSTRING, Variadic: true }
+    input := ArgumentSpec{ Name: "input", Type: ARGJSON }
+    listQuery := ArgumentSpec{ Name: "query", Type: ARGJSON, Optional: true }
+    transactionFilter := ArgumentSpec{ Name: "filter", Type: ARGJSON, Optional: true }
+    reason := ArgumentSpec{ Name: "reason", Type: ARGSTRING }
+    reasonCode := ArgumentSpec{ Name: "reasonCode", Type: ARGSTRING, Values: HALTREASONS }
+    FUNCTIONS = []FunctionSpec{
+        // Invokes
+        { Name: "init", Mutates: true, Role: ADMINROLE, Args: []ArgumentSpec{ { Name: "confirmation", Type: ARGSTRING, Optional: true, Values: []string{ RESETCONFIRMATION } } },
+            Description: "Sets up an empty ledger or migrates a populated one to the latest schema. A populated ledger is only reset by an admin passing the confirmation.", handler: (*DecodedChainCode).initLedger },
+        { Name: "addOwner", Mutates: true, Role: ROLEANY, handler: (*DecodedChainCode).addOwner,
+            Description: "Adds an owner.",
+            Args: []ArgumentSpec{ ownerId, { Name: "name", Type: ARGSTRING }, { Name: "balance", Type: ARGFLOAT },
+                { Name: "description", Type: ARGSTRING }, { Name: "logo", Type: ARGSTRING }, { Name: "tag", Type: ARGSTRING } } },
+        { Name: "addOwnerString", Mutates: true, Role: ROLEANY, handler: (*DecodedChainCode).addOwnerString,
+            Description: "Adds an owner, same as addOwner.",
+            Args: []ArgumentSpec{ ownerId, { Name: "name", Type: ARGSTRING }, { Name: "balance", Type: ARGFLOAT },
+                { Name: "description", Type: ARGSTRING }, { Name: "logo", Type: ARGSTRING }, { Name: "tag", Type: ARGSTRING } } },
+        { Name: "addOwnerJSON", Mutates: true, Role: ROLEANY, Args: []ArgumentSpec{ input },
+            Description: "Adds an owner from a JSON object.", handler: (*DecodedChainCode).addOwnerJSON },
+        { Name: "updateOwner", Mutates: true, Role: ROLEANY, Args: []ArgumentSpec{ ownerId, version, fieldValuePairs },
+            Description: "Changes the given fields of an owner.", handler: (*DecodedChainCode).updateOwner },
+        { Name: "updateOwnerJSON", Mutates: true, Role: ROLEANY, Args: []ArgumentSpec{ input },
+            Description: "Changes the given fields of an owner from a JSON object.", handler: (*DecodedChainCode).updateOwnerJSON },
+        { Name: "validateOwner", Mutates: true, Role: ADMINROLE, handler: (*DecodedChainCode).validateOwner,
+            Description: "Validates an owner to trade, with KYC metadata.",
+            Args: []ArgumentSpec{ ownerId, { Name: "reviewer", Type: ARGSTRING }, { Name: "expiry", Type: ARGSTRING },
+                { Name: "documentHash", Type: ARGSTRING } } },
+        { Name: "revokeOwnerValidation", Mutates: true, Role: ADMINROLE, Args: []ArgumentSpec{ ownerId, reason },
+            Description: "Revokes the validation of an owner.", handler: (*DecodedChainCode).revokeOwnerValidation },
+        { Name: "freezeOwner", Mutates: true, Role: ADMINROLE, Args: []ArgumentSpec{ ownerId, reason },
+            Description: "Stops an owner from trading.", handler: (*DecodedChainCode).freezeOwner },
+        { Name: "unfreezeOwner", Mutates: true, Role: ADMINROLE, Args: []ArgumentSpec{ ownerId, reason },
+            Description: "Lifts the freeze on an owner.", handler: (*DecodedChainCode).unfreezeOwner },
+        { Name: "closeOwner", Mutates: true, Role: ADMINROLE, Args: []ArgumentSpec{ ownerId, reason },
+            Description: "Closes an owner without balance or holdings.", handler: (*DecodedChainCode).closeOwner },
+        { Name: "addAssetString", Mutates: true, Role: ROLEANY, handler: (*DecodedChainCode).addAssetString,
+            Description: "Issues an asset to its issuer.",
+            Args: []ArgumentSpec{ assetId, { Name: "name", Type: ARGSTRING }, { Name: "issuerId", Type: ARGSTRING },
+                { Name: "quantity", Type: ARGINT }, { Name: "price", Type: ARGFLOAT }, { Name: "description", Type: ARGSTRING },
+                { Name: "logo", Type: ARGSTRING }, { Name: "approval", Type: ARGBOOL }, { Name: "approvalQty", Type: ARGINT },
+                { Name: "tag", Type: ARGSTRING } } },
+        { Name: "addAssetJSON", Mutates: true, Role: ROLEANY, Args: []ArgumentSpec{ input },
+            Description: "Issues an asset from a JSON object.", handler: (*DecodedChainCode).addAssetJSON },
+        { Name: "updateAsset", Mutates: true, Role: ROLEANY, Args: []ArgumentSpec{ assetId, version, fieldValuePairs },
+            Description: "Changes the given fields of an asset.", handler: (*DecodedChainCode).updateAsset },
+        { Name: "updateAssetJSON", Mutates: true, Role: ROLEANY, Args: []ArgumentSpec{ input },
+            Description: "Changes the given fields of an asset from a JSON object.", handler: (*DecodedChainCode).updateAssetJSON },
+        { Name: "transactAsset", Mutates: true, Role: ROLEANY, handler: (*DecodedChainCode).transactAsset,
+            Description: "Trades a quantity of an asset, pending approval when needed.",
+            Args: []ArgumentSpec{ assetId, { Name: "sellerId", Type: ARGSTRING }, { Name: "buyerId", Type: ARGSTRING },
+                { Name: "quantity", Type: ARGINT }, { Name: "price", Type: ARGFLOAT }, { Name: "approvalRequired", Type: ARGSTRING } } },
+        { Name: "transactAssetJSON", Mutates: true, Role: ROLEANY, Args: []ArgumentSpec{ input },
+            Description: "Trades a quantity of an asset from a JSON object.", handler: (*DecodedChainCode).transactAssetJSON },
+        { Name: "approveTransaction", Mutates: true, Role: ROLEANY, Args: []ArgumentSpec{ transactionId },
+            Description: "Approves a pending transaction.", handler: (*DecodedChainCode).approveTransaction },
+        { Name: "declineTransaction", Mutates: true, Role: ROLEANY, Args: []ArgumentSpec{ transactionId },
+            Description: "Declines a pending transaction and releases the escrow.", handler: (*DecodedChainCode).declineTransaction },
+        { Name: "haltTrading", Mutates: true, Role: ADMINROLE, Args: []ArgumentSpec{ reasonCode, reason },
+            Description: "Halts all trading.", handler: (*DecodedChainCode).haltTrading },
+        { Name: "resumeTrading", Mutates: true, Role: ADMINROLE, Args: []ArgumentSpec{},
+            Description: "Lifts the global halt.", handler: (*DecodedChainCode).resumeTrading },
+        { Name: "haltAssetTrading", Mutates: true, Role: ADMINROLE, Args: []ArgumentSpec{ assetId, reasonCode, reason },
+            Description: "Halts trading in a single asset.", handler: (*DecodedChainCode).haltAssetTrading },
+        { Name: "resumeAssetTrading", Mutates: true, Role: ADMINROLE, Args: []ArgumentSpec{ assetId },
+            Description: "Lifts the halt on a single asset.", handler: (*DecodedChainCode).resumeAssetTrading },
+        { Name: "migrateStateKeys", Mutates: true, Role: ADMINROLE, Args: []ArgumentSpec{},
+            Description: "Moves state written before key namespacing.", handler: (*DecodedChainCode).migrateStateKeys },
+        { Name: "setCostBasisMethod", Mutates: true, Role: ADMINROLE,
+            Args: []ArgumentSpec{ { Name: "method", Type: ARGSTRING, Values: COSTBASISMETHODS } },
+            Description: "Sets the cost basis method of the profit and loss.", handler: (*DecodedChainCode).setCostBasisMethod },
+        { Name: "setCandleIntervals", Mutates: true, Role: ADMINROLE,
+            Args: []ArgumentSpec{ { Name: "intervals", Type: ARGINT, Variadic: true } },
+            Description: "Sets the candle intervals in seconds.", handler: (*DecodedChainCode).setCandleIntervals },
+        { Name: "resetLedger", Mutates: true, Role: ADMINROLE,
+            Args: []ArgumentSpec{ { Name: "confirmation", Type: ARGSTRING, Values: []string{ RESETCONFIRMATION } } },
+            Description: "Deletes every record, keeping the marketplace settings.", handler: (*DecodedChainCode).resetLedger },
+        { Name: "importLedger", Mutates: true, Role: ADMINROLE, Args: []ArgumentSpec{ { Name: "snapshot", Type: ARGJSON } },
+            Description: "Restores a snapshot from exportLedger into an empty ledger.", handler: (*DecodedChainCode).importLedger },
+        { Name: "reconcileOwnership", Mutates: true, Role: ADMINROLE, Args: []ArgumentSpec{},
+            Description: "Rebuilds the owner side of the ownership from the assets.", handler: (*DecodedChainCode).reconcileOwnership },
+        // Queries
+        { Name: "read", Mutates: false, Role: ROLEANY, handler: (*DecodedChainCode).read,
+            Description: "Reads the state of an entity, for example an owner, asset or transaction.",
+            Args: []ArgumentSpec{ { Name: "entityType", Type: ARGSTRING }, { Name: "id", Type: ARGSTRING } } },
+        { Name: "readAll", Mutates: false, Role: ROLEANY, Args: []ArgumentSpec{},
+            Description: "Reads the ids in the main ledgers.", handler: (*DecodedChainCode).readAll },
+        { Name: "readAllOwners", Mutates: false, Role: ROLEANY, Args: []ArgumentSpec{ listQuery },
+            Description: "Reads a page of owners.", handler: (*DecodedChainCode).readAllOwners },
+        { Name: "readAllAssets", Mutates: false, Role: ROLEANY, Args: []ArgumentSpec{ listQuery },
+            Description: "Reads a page of assets.", handler: (*DecodedChainCode).readAllAssets },
+        { Name: "readAllTransactions", Mutates: false, Role: ROLEANY, Args: []ArgumentSpec{ listQuery },
+            Description: "Reads a page of transactions.", handler: (*DecodedChainCode).readAllTransactions },
+        { Name: "readPendingTransactions", Mutates: false, Role: ROLEANY, Args: []ArgumentSpec{ listQuery },
+            Description: "Reads a page of pending transactions with their escrow and approver.", handler: (*DecodedChainCode).readPendingTransactions },
+        { Name: "readOwnerTransactions", Mutates: false, Role: ROLEANY, Args: []ArgumentSpec{ ownerId, transactionFilter },
+            Description: "Reads the transactions of an owner.", handler: (*DecodedChainCode).readOwnerTransactions },
+        { Name: "readAssetTransactions", Mutates: false, Role: ROLEANY, Args: []ArgumentSpec{ assetId, transactionFilter },
+            Description: "Reads the transactions of an asset.", handler: (*DecodedChainCode).readAssetTransactions },
+        { Name: "readPortfolio", Mutates: false, Role: ROLEANY, Args: []ArgumentSpec{ ownerId },
+            Description: "Reads the holdings and value of an owner.", handler: (*DecodedChainCode).readPortfolio },
+        { Name: "readProfitAndLoss", Mutates: false, Role: ROLEANY, Args: []ArgumentSpec{ ownerId },
+            Description: "Reads the cost basis and profit of an owner.", handler: (*DecodedChainCode).readProfitAndLoss },
+        { Name: "readMarketStats", Mutates: false, Role: ROLEANY, Args: []ArgumentSpec{ assetId },
+            Description: "Reads the last price, volume and VWAP of an asset.", handler: (*DecodedChainCode).readMarketStats },
+        { Name: "readCandles", Mutates: false, Role: ROLEANY, handler: (*DecodedChainCode).readCandles,
+            Description: "Reads the OHLC candles of an asset. from and to are given together.",
+            Args: []ArgumentSpec{ assetId, { Name: "interval", Type: ARGINT },
+                { Name: "from", Type: ARGINT, Optional: true, NonNegative: true }, { Name: "to", Type: ARGINT, Optional: true, NonNegative: true } } },
+        { Name: "readCapTable", Mutates: false, Role: ROLEANY, handler: (*DecodedChainCode).readCapTable,
+            Description: "Reads the cap tables of the assets an owner issued.",
+            Args: []ArgumentSpec{ { Name: "issuerId", Type: ARGSTRING },
+                { Name: "format", Type: ARGSTRING, Optional: true, Values: []string{ "json", "csv" } },
+                { Name: "topN", Type: ARGINT, Optional: true } } },
+        { Name: "readTradingHalts", Mutates: false, Role: ROLEANY, Args: []ArgumentSpec{},
+            Description: "Reads the global and per asset trading halts.", handler: (*DecodedChainCode).readTradingHalts },
+        { Name: "readTradingStatus", Mutates: false, Role: ROLEANY, Args: []ArgumentSpec{ assetId },
+            Description: "Reads whether an asset can be traded.", handler: (*DecodedChainCode).readTradingStatus },
+        { Name: "checkInvariants", Mutates: false, Role: ROLEANY, Args: []ArgumentSpec{},
+            Description: "Lists every inconsistency in the ledger.", handler: (*DecodedChainCode).checkInvariants },
+        { Name: "readRepairLog", Mutates: false, Role: ROLEANY, Args: []ArgumentSpec{ listQuery },
+            Description: "Reads a page of the changes made by reconcileOwnership.", handler: (*DecodedChainCode).readRepairLog },
+        { Name: "exportLedger", Mutates: false, Role: ADMINROLE, Args: []ArgumentSpec{},
+            Description: "Reads a snapshot of every owner, asset, transaction and ledger.", handler: (*DecodedChainCode).exportLedger },
+        { Name: "readSchemaVersion", Mutates: false, Role: ROLEANY, Args: []ArgumentSpec{},
+            Description: "Reads the schema version of the state and the migrations.", handler: (*DecodedChainCode).readSchemaVersion },
+        { Name: "listFunctions", Mutates: false, Role: ROLEANY, Args: []ArgumentSpec{},
+            Description: "Lists the registered functions with their arguments.", handler: (*DecodedChainCode).listFunctions },
+    }
+}
+
+
+// ============================================================================================================================
+
+
+func lookupFunction(fn string) (FunctionSpec, bool) {
+    for _, spec := range FUNCTIONS {
+        if spec.Name == fn {
+            return spec, true
+        }
+    }
+    return FunctionSpec{}, false
+} // end of lookupFunction
+
+
+// Checks the number of arguments and the type of every argument against the schema.
+func (spec FunctionSpec) validateArgs(args []string) (error) {
+    required := 0
+    for _, arg := range spec.Args {
+        if arg.Optional == false && arg.Variadic == false {
+            required++
+        }
+    }
+    isVariadic := len(spec.Args) > 0 && spec.Args[len(spec.Args) - 1].Variadic
+    if isVariadic {
+        required++ // A variadic argument is given at least once.
+    }
+    if len(args) < required || (isVariadic == false && len(args) > len(spec.Args)) {
+        return argumentCountError(spec.Name)
+    }
+    fieldErrors := FieldErrors{}
+    for i, value := range args {
+        arg := spec.Args[len(spec.Args) - 1]
+        if i < len(spec.Args) {
+            arg = spec.Args[i]
+        }
+        if _, ok := fieldErrors[arg.Name]; ok {
+            continue
+        }
+        switch arg.Type {
+            case ARGINT:
+                if number, err := strconv.Atoi(value); err != nil {
+                    fieldErrors[arg.Name] = "must be a whole number"
+                } else if arg.NonNegative && number < 0 {
+                    fieldErrors[arg.Name] = "must not be negative"
+                }
+            case ARGFLOAT:
+                if number, err := strconv.ParseFloat(value, 64); err != nil {
+                    fieldErrors[arg.Name] = "must be a number"
+                } else if arg.NonNegative && number < 0 {
+                    fieldErrors[arg.Name] = "must not be negative"
+                }
+            case ARGBOOL:
+                if _, err := strconv.ParseBool(value); err != nil {
+                    fieldErrors[arg.Name] = "must be true or false"
+                }
+            case ARGJSON:
+                var decoded interface{}
+                if err := json.Unmarshal([]byte(value), &decoded); err != nil {
+                    fieldErrors[arg.Name] = "must be valid JSON"
+                }
+        }
+        if _, ok := fieldErrors[arg.Name]; ok == false && len(arg.Values) > 0 && utils.IsElementInSlice(arg.Values, value) == false {
+            fieldErrors[arg.Name] = "is not one of the allowed values"
+        }
+    }
+    return fieldErrors.toError(spec.Name)
+} // end of spec.validateArgs
+
+
+// ============================================================================================================================
+
+
+// Looks up the function, checks it can be called this way, by this caller and with these arguments, and runs it.
+func (dcc *DecodedChainCode) dispatch(stub shim.ChaincodeStubInterface, fn string, args []string, isInvoke bool) ([]byte, error) {
+    var err error
+    spec, ok := lookupFunction(fn)
+    if ok == false {
+        err = newChaincodeError(ERRUNKNOWNFUNCTION, fn, "Received unknown function " + fn)
+        utils.PrintErrorFull("dispatch", err)
+        return nil, err
+    }
+    if spec.Mutates && isInvoke == false {
+        err = newChaincodeError(ERRUNKNOWNFUNCTION, fn, fn + " changes state and can only be invoked")
+        utils.PrintErrorFull("dispatch", err)
+        return nil, err
+    }
+    if spec.Mutates == false && isInvoke {
+        err = newChaincodeError(ERRUNKNOWNFUNCTION, fn, fn + " is a query and can only be queried")
+        utils.PrintErrorFull("dispatch", err)
+        return nil, err
+    }
+    if spec.Role == ADMINROLE {
+        if err = dcc.verifyAdmin(stub, fn); err != nil {
+            utils.PrintErrorFull("dispatch - verifyAdmin", err)
+            return nil, err
+        }
+    }
+    if err = spec.validateArgs(args); err != nil {
+        utils.PrintErrorFull("dispatch - validateArgs", err)
+        return nil, err
+    }
+    return spec.handler(dcc, stub, fn, args)
+} // end of dcc.dispatch
+
+
+// Returns the registry, in the order the functions are registered.
+func (dcc *DecodedChainCode) listFunctions(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
+    functionsBytes, err := json.Marshal(&FUNCTIONS)
+    if err != nil {
+        utils.PrintErrorFull("listFunctions - Marshal", err)
+        return nil, err
+    }
+    utils.PrintSuccess("Listed the registered functions")
+    return functionsBytes, nil
+} // end of dcc.listFunctions
+
+
+// ============================================================================================================================
@@ -0,0 +1,149 @@
+/*
+
+DECODED HYPERLEDGER APPLICATION
+
+Resetting the ledger. Init only sets up an empty ledger; once the ledger holds records it refuses to run, unless an
+admin passes RESETCONFIRMATION. resetLedger (admin) deletes every record: owners (closed ones included), assets,
+transactions, the ledgers that index them, positions, market data and the repair log. The marketplace settings
+under the system keys, such as trading halts, the cost basis method and the schema version, are kept.
+
+    {"deleted":{"asset":2, "ledger":14, "owner":3, ...}}
+
+Functions:
+- recordTypes
+
+DecodedChainCode functions:
+- isLedgerEmpty - private function
+- deleteRecords - private function
+- resetLedger
+
+*/
+
+
+package main
+
+
+import (
+    "encoding/json"
+    "strconv"
+
+    "github.com/hyperledger/fabric/core/chaincode/shim"
+
+    utils "github.com/DecodedCo/blockchain-marketplace-chaincode/utils"
+)
+
+
+// ============================================================================================================================
+
+
+// The argument that confirms a populated ledger is to be reset.
+const RESETCONFIRMATION = "RESET_LEDGER"
+
+// Entity types that are kept on a reset.
+var SETTINGTYPES = []string{ "system" }
+
+
+type ResetReport struct {
+    Deleted     map[string]int      `json:"deleted"` // Number of records deleted per entity type.
+}
+
+
+// ============================================================================================================================
+
+
+// Every entity type that holds records, sorted.
+func recordTypes() ([]string) {
+    entityTypes := map[string]bool{}
+    for entityType := range ENTITYPREFIX {
+        if utils.IsElementInSlice(SETTINGTYPES, entityType) == false {
+            entityTypes[entityType] = true
+        }
+    }
+    return sortedKeys(entityTypes)
+}
+
+
+// ============================================================================================================================
+
+
+func (dcc *DecodedChainCode) isLedgerEmpty(stub shim.ChaincodeStubInterface) (bool, error) {
+    for _, entityType := range recordTypes() {
+        startKey, endKey := prefixRange(ENTITYPREFIX[entityType])
+        iterator, err := stub.RangeQueryState(startKey, endKey)
+        if err != nil {
+            return false, err
+        }
+        hasRecords := iterator.HasNext()
+        iterator.Close()
+        if hasRecords {
+            return false, nil
+        }
+    }
+    // Ledgers from before the namespacing kept their ledgers under the bare names.
+    for _, ledgerName := range PRIMARYKEY {
+        legacyBytes, err := stub.GetState(ledgerName)
+        if err != nil {
+            return false, err
+        }
+        if legacyBytes != nil {
+            return false, nil
+        }
+    }
+    return true, nil
+} // end of dcc.isLedgerEmpty
+
+
+// The keys are collected before they are deleted, so the range queries never see their own deletes.
+func (dcc *DecodedChainCode) deleteRecords(stub shim.ChaincodeStubInterface) (ResetReport, error) {
+    report := ResetReport{ Deleted: make(map[string]int) }
+    for _, entityType := range recordTypes() {
+        startKey, endKey := prefixRange(ENTITYPREFIX[entityType])
+        iterator, err := stub.RangeQueryState(startKey, endKey)
+        if err != nil {
+            return report, err
+        }
+        keys := []string{}
+        for iterator.HasNext() {
+            key, _, err := iterator.Next()
+            if err != nil {
+                iterator.Close()
+                return report, err
+            }
+            keys = append(keys, key)
+        }
+        iterator.Close()
+        for _, key := range keys {
+            if err = stub.DelState(key); err != nil {
+                return report, err
+            }
+        }
+        report.Deleted[entityType] = len(keys)
+    }
+    return report, nil
+} // end of dcc.deleteRecords
+
+
+// Args: RESETCONFIRMATION.
+func (dcc *DecodedChainCode) resetLedger(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
+    var err error
+    report, err := dcc.deleteRecords(stub)
+    if err != nil {
+        utils.PrintErrorFull("resetLedger - deleteRecords", err)
+        return nil, err
+    }
+    details := map[string]string{}
+    for entityType, count := range report.Deleted {
+        details[entityType] = strconv.Itoa(count)
+    }
+    recordEvent(stub, EVENTLEDGERRESET, "", details)
+    reportBytes, err := json.Marshal(&report)
+    if err != nil {
+        utils.PrintErrorFull("resetLedger - Marshal", err)
+        return nil, err
+    }
+    utils.PrintSuccess("Reset the ledger")
+    return reportBytes, nil
+} // end of dcc.resetLedger
+
+
+// ============================================================================================================================
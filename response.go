@@ -0,0 +1,125 @@
+/*
+
+DECODED HYPERLEDGER APPLICATION
+
+Invokes return a JSON result instead of an empty payload, so the caller learns what it created and where it stands:
+
+    {"function":"transactAsset", "id":"<transactionId>", "status":"Pending", "transaction":{...},
+     "balances":[{"ownerId":"bc", "balance":900, "escrowBalance":100}], "holdings":[{"assetId":"appleId", "ownerId":"dcd", ...}]}
+
+- id: the owner, asset or transaction the invoke created or changed.
+- status: what happened, for trades the status of the transaction.
+- version: the version of an updated owner or asset.
+- balances and holdings: the balances and asset holdings the invoke changed.
+- migration: the schema migrations Init ran, with status "Migrated".
+
+The report invokes (migrateStateKeys, reconcileOwnership, resetLedger, importLedger) return their report instead.
+
+Functions:
+- newInvokeResult
+
+InvokeResult functions:
+- addBalance
+- addHolding
+- toBytes
+
+DecodedChainCode functions:
+- tradeResult - private function
+
+*/
+
+
+package main
+
+
+import (
+    "encoding/json"
+
+    "github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+
+// ============================================================================================================================
+
+
+type BalanceResult struct {
+    OwnerId         string          `json:"ownerId"`
+    Balance         float64         `json:"balance"`
+    EscrowBalance   float64         `json:"escrowBalance"`
+}
+
+
+type HoldingResult struct {
+    AssetId         string          `json:"assetId"`
+    OwnerId         string          `json:"ownerId"`
+    Quantity        int             `json:"quantity"`
+    EscrowQty       int             `json:"escrowQty"`
+}
+
+
+type InvokeResult struct {
+    Function        string          `json:"function"`
+    Id              string          `json:"id,omitempty"`
+    Status          string          `json:"status"`
+    Version         int             `json:"version,omitempty"`
+    Transaction     *Transaction    `json:"transaction,omitempty"`
+    Balances        []BalanceResult `json:"balances,omitempty"`
+    Holdings        []HoldingResult `json:"holdings,omitempty"`
+    Migration       *SchemaMigrationReport `json:"migration,omitempty"`
+}
+
+
+// ============================================================================================================================
+
+
+func newInvokeResult(fn string, id string, status string) (InvokeResult) {
+    return InvokeResult{ Function: fn, Id: id, Status: status }
+}
+
+
+func (r *InvokeResult) addBalance(owner Owner) {
+    r.Balances = append(r.Balances, BalanceResult{ OwnerId: owner.OwnerId, Balance: owner.Balance, EscrowBalance: owner.EscrowBalance })
+} // end of r.addBalance
+
+
+// Owners that no longer hold the asset are listed with zero quantities.
+func (r *InvokeResult) addHolding(asset Asset, ownerId string) {
+    ownedBy := asset.OwnedBy[ownerId]
+    r.Holdings = append(r.Holdings, HoldingResult{ AssetId: asset.Id, OwnerId: ownerId, Quantity: ownedBy.Quantity, EscrowQty: ownedBy.EscrowQty })
+} // end of r.addHolding
+
+
+func (r *InvokeResult) toBytes() ([]byte, error) {
+    return json.Marshal(r)
+} // end of r.toBytes
+
+
+// ============================================================================================================================
+
+
+// The result of a trade invoke: the transaction with its final price and status, and the balances and holdings of both counterparties.
+func (dcc *DecodedChainCode) tradeResult(stub shim.ChaincodeStubInterface, fn string, transaction Transaction) ([]byte, error) {
+    var err error
+    result := newInvokeResult(fn, transaction.Id, transaction.Status)
+    result.Transaction = &transaction
+    buyer, err := dcc.getOwner(stub, []string{ transaction.BuyerId })
+    if err != nil {
+        return nil, err
+    }
+    seller, err := dcc.getOwner(stub, []string{ transaction.SellerId })
+    if err != nil {
+        return nil, err
+    }
+    asset, err := dcc.getAsset(stub, []string{ transaction.AssetId })
+    if err != nil {
+        return nil, err
+    }
+    result.addBalance(buyer)
+    result.addBalance(seller)
+    result.addHolding(asset, buyer.OwnerId)
+    result.addHolding(asset, seller.OwnerId)
+    return result.toBytes()
+} // end of dcc.tradeResult
+
+
+// ============================================================================================================================
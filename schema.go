@@ -0,0 +1,277 @@
+/*
+
+DECODED HYPERLEDGER APPLICATION
+
+Versioning of the state schema. Records are stored as JSON, so a record written before a field was added reads
+back with the zero value of that field. The version of the schema the state follows is kept under
+system:SchemaVersion, and every change to the shape of the records comes with a migration that brings older
+records up to date:
+
+    1. Moves the state to the namespaced keys and ledger entries (see keys.go).
+    2. Records the escrowed funds of the pending transactions that predate the escrow field.
+    3. Moves the recent trades kept in the market statistics into the buckets of the 24h window.
+
+The latest version is the number of migrations. When the chaincode is upgraded, Init runs the migrations the
+state has not had yet, in order, records SCHEMA_MIGRATED and returns a report of what they changed in its result:
+
+    {"function":"init", "status":"Migrated", "migration":{"from":0, "to":3, "migrations":[{"version":1, "description":"...", "changed":{"owner":3}, "conflicts":[]}, ...]}}
+
+A populated ledger without a stored version is at version 0. A new ledger starts at the latest version.
+readSchemaVersion returns the version of the state and the migrations with whether they have been applied.
+
+Functions:
+- latestSchemaVersion
+
+DecodedChainCode functions:
+- getSchemaVersion - private function
+- setSchemaVersion - private function
+- migrateLegacyKeys - private function, migration 1.
+- backfillEscrow - private function, migration 2.
+- bucketRecentTrades - private function, migration 3.
+- migrateSchema - private function
+- readSchemaVersion
+
+*/
+
+
+package main
+
+
+import (
+    "encoding/json"
+    "strconv"
+
+    "github.com/hyperledger/fabric/core/chaincode/shim"
+
+    utils "github.com/DecodedCo/blockchain-marketplace-chaincode/utils"
+)
+
+
+// ============================================================================================================================
+
+
+const SCHEMAVERSIONKEY = "SchemaVersion"
+
+
+// A migration brings the state from the previous version to Version. It fills in what it changed.
+type Migration struct {
+    Version     int
+    Description string
+    apply       func(dcc *DecodedChainCode, stub shim.ChaincodeStubInterface, result *MigrationResult) (error)
+}
+
+
+// Append only: a released migration is never changed or removed, its version is stored in deployed ledgers.
+var MIGRATIONS = []Migration{
+    { Version: 1, Description: "Moves the state to namespaced keys and ledger entries.", apply: (*DecodedChainCode).migrateLegacyKeys },
+    { Version: 2, Description: "Records the escrowed funds of pending transactions.", apply: (*DecodedChainCode).backfillEscrow },
+    { Version: 3, Description: "Moves the recent trades of the market statistics into the 24h window.", apply: (*DecodedChainCode).bucketRecentTrades },
+}
+
+
+type MigrationResult struct {
+    Version     int                 `json:"version"`
+    Description string              `json:"description"`
+    Changed     map[string]int      `json:"changed"` // Number of records changed per entity type.
+    Conflicts   []string            `json:"conflicts"` // Records the migration could not change.
+}
+
+
+type SchemaMigrationReport struct {
+    From        int                 `json:"from"`
+    To          int                 `json:"to"`
+    Migrations  []MigrationResult   `json:"migrations"`
+}
+
+
+type MigrationStatus struct {
+    Version     int                 `json:"version"`
+    Description string              `json:"description"`
+    Applied     bool                `json:"applied"`
+}
+
+
+type SchemaVersion struct {
+    Version     int                 `json:"version"`
+    Latest      int                 `json:"latest"`
+    Migrations  []MigrationStatus   `json:"migrations"`
+}
+
+
+// ============================================================================================================================
+
+
+func latestSchemaVersion() (int) {
+    return len(MIGRATIONS)
+}
+
+
+// ============================================================================================================================
+
+
+// The state has no stored version until the first Init of a chaincode that versions its schema.
+func (dcc *DecodedChainCode) getSchemaVersion(stub shim.ChaincodeStubInterface) (int, error) {
+    var err error
+    versionBytes, err := stub.GetState(systemKey(SCHEMAVERSIONKEY))
+    if err != nil {
+        return 0, err
+    }
+    if versionBytes == nil {
+        return 0, nil
+    }
+    version, err := strconv.Atoi(string(versionBytes))
+    if err != nil {
+        return 0, err
+    }
+    return version, nil
+} // end of dcc.getSchemaVersion
+
+
+func (dcc *DecodedChainCode) setSchemaVersion(stub shim.ChaincodeStubInterface, version int) (error) {
+    return stub.PutState(systemKey(SCHEMAVERSIONKEY), []byte(strconv.Itoa(version)))
+} // end of dcc.setSchemaVersion
+
+
+// ============================================================================================================================
+
+
+func (dcc *DecodedChainCode) migrateLegacyKeys(stub shim.ChaincodeStubInterface, result *MigrationResult) (error) {
+    var err error
+    report, err := dcc.moveLegacyState(stub)
+    if err != nil {
+        return err
+    }
+    result.Changed = report.Moved
+    result.Conflicts = report.Conflicts
+    return nil
+} // end of dcc.migrateLegacyKeys
+
+
+// Pending transactions from before the escrow was recorded escrowed the undiscounted amount, see escrowedAmount.
+func (dcc *DecodedChainCode) backfillEscrow(stub shim.ChaincodeStubInterface, result *MigrationResult) (error) {
+    var err error
+    var emptyArgs []string
+    pendingLedger, err := dcc.getDataArrayStrings(stub, PRIMARYKEY[3], emptyArgs)
+    if err != nil {
+        return err
+    }
+    for _, transactionId := range pendingLedger {
+        transaction, err := dcc.getTransaction(stub, []string{ transactionId })
+        if err != nil {
+            result.Conflicts = append(result.Conflicts, "transaction " + transactionId + ": " + err.Error())
+            continue
+        }
+        if transaction.Status != "Pending" || transaction.Escrowed != 0 || transaction.escrowedAmount() == 0 {
+            continue
+        }
+        transaction.Escrowed = transaction.escrowedAmount()
+        if err = transaction.save(stub); err != nil {
+            return err
+        }
+        result.Changed["transaction"] = result.Changed["transaction"] + 1
+    }
+    return nil
+} // end of dcc.backfillEscrow
+
+
+// The market statistics kept the trades of the last 24 hours in the record itself, oldest first.
+func (dcc *DecodedChainCode) bucketRecentTrades(stub shim.ChaincodeStubInterface, result *MigrationResult) (error) {
+    var err error
+    statsKeys := []string{}
+    startKey, endKey := prefixRange(ENTITYPREFIX["market"])
+    iterator, err := stub.RangeQueryState(startKey, endKey)
+    if err != nil {
+        return err
+    }
+    for iterator.HasNext() {
+        key, _, err := iterator.Next()
+        if err != nil {
+            iterator.Close()
+            return err
+        }
+        statsKeys = append(statsKeys, key)
+    }
+    iterator.Close()
+    for _, key := range statsKeys {
+        var legacy struct {
+            MarketStats
+            Recent  []Trade     `json:"recentTrades"`
+        }
+        statsBytes, err := stub.GetState(key)
+        if err != nil {
+            return err
+        }
+        if err = json.Unmarshal(statsBytes, &legacy); err != nil {
+            result.Conflicts = append(result.Conflicts, key + ": " + err.Error())
+            continue
+        }
+        if legacy.Recent == nil {
+            continue
+        }
+        for _, trade := range legacy.Recent {
+            if err = dcc.addToWindow(stub, legacy.AssetId, trade); err != nil {
+                return err
+            }
+        }
+        if err = legacy.MarketStats.save(stub); err != nil {
+            return err
+        }
+        result.Changed["market"] = result.Changed["market"] + 1
+    }
+    return nil
+} // end of dcc.bucketRecentTrades
+
+
+// Runs the migrations the state has not had yet. The version is stored after each of them.
+func (dcc *DecodedChainCode) migrateSchema(stub shim.ChaincodeStubInterface, fn string) (SchemaMigrationReport, error) {
+    var err error
+    report := SchemaMigrationReport{ Migrations: []MigrationResult{} }
+    report.From, err = dcc.getSchemaVersion(stub)
+    if err != nil {
+        utils.PrintErrorFull("migrateSchema - getSchemaVersion", err)
+        return report, err
+    }
+    report.To = report.From
+    for _, migration := range MIGRATIONS {
+        if migration.Version <= report.From {
+            continue
+        }
+        result := MigrationResult{ Version: migration.Version, Description: migration.Description, Changed: make(map[string]int), Conflicts: []string{} }
+        if err = migration.apply(dcc, stub, &result); err != nil {
+            utils.PrintErrorFull("migrateSchema - migration " + strconv.Itoa(migration.Version), err)
+            return report, err
+        }
+        if err = dcc.setSchemaVersion(stub, migration.Version); err != nil {
+            utils.PrintErrorFull("migrateSchema - setSchemaVersion", err)
+            return report, err
+        }
+        report.Migrations = append(report.Migrations, result)
+        report.To = migration.Version
+    }
+    recordEvent(stub, EVENTSCHEMAMIGRATED, "", map[string]string{ "from": strconv.Itoa(report.From), "to": strconv.Itoa(report.To) })
+    utils.PrintSuccess("Migrated the schema from version " + strconv.Itoa(report.From) + " to " + strconv.Itoa(report.To))
+    return report, nil
+} // end of dcc.migrateSchema
+
+
+func (dcc *DecodedChainCode) readSchemaVersion(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
+    var err error
+    version, err := dcc.getSchemaVersion(stub)
+    if err != nil {
+        utils.PrintErrorFull("readSchemaVersion - getSchemaVersion", err)
+        return nil, err
+    }
+    schemaVersion := SchemaVersion{ Version: version, Latest: latestSchemaVersion(), Migrations: []MigrationStatus{} }
+    for _, migration := range MIGRATIONS {
+        schemaVersion.Migrations = append(schemaVersion.Migrations, MigrationStatus{ Version: migration.Version, Description: migration.Description, Applied: migration.Version <= version })
+    }
+    schemaVersionBytes, err := json.Marshal(&schemaVersion)
+    if err != nil {
+        utils.PrintErrorFull("readSchemaVersion - Marshal", err)
+        return nil, err
+    }
+    return schemaVersionBytes, nil
+} // end of dcc.readSchemaVersion
+
+
+// ============================================================================================================================
@@ -0,0 +1,311 @@
+/*
+
+DECODED HYPERLEDGER APPLICATION
+
+Ledger snapshots, to move a marketplace between networks and to set up test fixtures. exportLedger (admin) returns
+every owner (closed ones included), asset and transaction with the entries of the main ledgers and of the per asset
+transaction ledgers:
+
+    {"format":1, "schemaVersion":2, "owners":{"dcd":{...}}, "assets":{...}, "transactions":{...},
+     "ledgers":{"AssetTransactions:appleId":["<transactionId>"], "Owners":["bc","dcd"], ...}}
+
+The document is deterministic: records are keyed by id, the keys are sorted and the ledger entries are in key order,
+so exporting the same state twice gives the same bytes. Positions, market data, the repair log and the marketplace
+settings are not part of it.
+
+importLedger (admin) restores a snapshot into an empty ledger. The snapshot has to be of SNAPSHOTFORMAT and of the
+latest schema version, every record has to be stored under its own id, and the ledger invariants have to hold
+(see invariants.go); otherwise nothing is written.
+
+    {"imported":{"asset":1, "ledger":9, "owner":3, "transaction":2}}
+
+DecodedChainCode functions:
+- loadSnapshot - private function
+- verifySnapshot - private function
+- exportLedger
+- importLedger
+
+*/
+
+
+package main
+
+
+import (
+    "encoding/json"
+    "strconv"
+    "strings"
+
+    "github.com/hyperledger/fabric/core/chaincode/shim"
+
+    utils "github.com/DecodedCo/blockchain-marketplace-chaincode/utils"
+)
+
+
+// ============================================================================================================================
+
+
+// Increased when the layout of the snapshot changes. The layout of the records follows the schema version.
+const SNAPSHOTFORMAT = 1
+
+
+type LedgerSnapshot struct {
+    Format          int         `json:"format"`
+    SchemaVersion   int         `json:"schemaVersion"`
+    LedgerData
+}
+
+
+type ImportReport struct {
+    Imported    map[string]int      `json:"imported"` // Number of records imported per entity type.
+}
+
+
+// ============================================================================================================================
+
+
+// Reads every record of the entity types in the snapshot with range queries, so records that are in no ledger
+// (closed owners) are included. Of the ledgers only the main ledgers and the transaction ledgers of the assets are
+// read; the others, such as the repair log, are not part of the snapshot.
+func (dcc *DecodedChainCode) loadSnapshot(stub shim.ChaincodeStubInterface) (LedgerSnapshot, error) {
+    var err error
+    var emptyArgs []string
+    snapshot := LedgerSnapshot{ Format: SNAPSHOTFORMAT }
+    snapshot.Owners = make(map[string]Owner)
+    snapshot.Assets = make(map[string]Asset)
+    snapshot.Transactions = make(map[string]Transaction)
+    snapshot.Ledgers = make(map[string][]string)
+    snapshot.SchemaVersion, err = dcc.getSchemaVersion(stub)
+    if err != nil {
+        return snapshot, err
+    }
+    for _, entityType := range []string{ "owner", "asset", "transaction" } {
+        prefix := ENTITYPREFIX[entityType]
+        startKey, endKey := prefixRange(prefix)
+        iterator, err := stub.RangeQueryState(startKey, endKey)
+        if err != nil {
+            return snapshot, err
+        }
+        for iterator.HasNext() {
+            key, valueBytes, err := iterator.Next()
+            if err != nil {
+                iterator.Close()
+                return snapshot, err
+            }
+            id := strings.TrimPrefix(key, prefix)
+            switch entityType {
+                case "owner":
+                    var owner Owner
+                    err = json.Unmarshal(valueBytes, &owner)
+                    snapshot.Owners[id] = owner
+                case "asset":
+                    var asset Asset
+                    err = json.Unmarshal(valueBytes, &asset)
+                    snapshot.Assets[id] = asset
+                case "transaction":
+                    var transaction Transaction
+                    err = json.Unmarshal(valueBytes, &transaction)
+                    snapshot.Transactions[id] = transaction
+            }
+            if err != nil {
+                iterator.Close()
+                return snapshot, err
+            }
+        }
+        iterator.Close()
+    }
+    ledgerNames := append([]string{}, PRIMARYKEY[:]...)
+    for assetId := range snapshot.Assets {
+        ledgerNames = append(ledgerNames, assetTransactionsLedger(assetId))
+    }
+    for _, ledgerName := range ledgerNames {
+        entries, err := dcc.getDataArrayStrings(stub, ledgerName, emptyArgs)
+        if err != nil {
+            return snapshot, err
+        }
+        if len(entries) > 0 {
+            snapshot.Ledgers[ledgerName] = entries
+        }
+    }
+    return snapshot, nil
+} // end of dcc.loadSnapshot
+
+
+// Checks what the invariants do not: the format, the schema version, the ids and the ledger names.
+func (dcc *DecodedChainCode) verifySnapshot(fn string, snapshot LedgerSnapshot) (error) {
+    var err error
+    fieldErrors := FieldErrors{}
+    if snapshot.Format != SNAPSHOTFORMAT {
+        fieldErrors["format"] = "must be " + strconv.Itoa(SNAPSHOTFORMAT)
+    }
+    if snapshot.SchemaVersion != latestSchemaVersion() {
+        err = newChaincodeError(ERRSCHEMAVERSION, fn, "The snapshot follows schema version " + strconv.Itoa(snapshot.SchemaVersion) + ", the ledger version " + strconv.Itoa(latestSchemaVersion())).withDetail("schemaVersion", strconv.Itoa(snapshot.SchemaVersion))
+        return err
+    }
+    for id, owner := range snapshot.Owners {
+        if strings.Contains(id, KEYSEPARATOR) {
+            fieldErrors["owners." + id] = "must not contain " + KEYSEPARATOR
+        } else if id == "" || owner.OwnerId != id {
+            fieldErrors["owners." + id] = "holds owner " + owner.OwnerId
+        }
+    }
+    for id, asset := range snapshot.Assets {
+        if strings.Contains(id, KEYSEPARATOR) {
+            fieldErrors["assets." + id] = "must not contain " + KEYSEPARATOR
+        } else if id == "" || asset.Id != id {
+            fieldErrors["assets." + id] = "holds asset " + asset.Id
+        }
+    }
+    for id, transaction := range snapshot.Transactions {
+        if strings.Contains(id, KEYSEPARATOR) {
+            fieldErrors["transactions." + id] = "must not contain " + KEYSEPARATOR
+        } else if id == "" || transaction.Id != id {
+            fieldErrors["transactions." + id] = "holds transaction " + transaction.Id
+        }
+    }
+    for ledgerName, entries := range snapshot.Ledgers {
+        if utils.IsElementInSlice(PRIMARYKEY[:], ledgerName) {
+            continue
+        }
+        assetId := strings.TrimPrefix(ledgerName, assetTransactionsLedger(""))
+        if _, ok := snapshot.Assets[assetId]; ok == false || ledgerName != assetTransactionsLedger(assetId) {
+            fieldErrors["ledgers." + ledgerName] = "is not a known ledger"
+            continue
+        }
+        for _, transactionId := range entries {
+            if transaction, ok := snapshot.Transactions[transactionId]; ok == false || transaction.AssetId != assetId {
+                fieldErrors["ledgers." + ledgerName] = "lists transaction " + transactionId + " that is not of asset " + assetId
+            }
+        }
+    }
+    return fieldErrors.toError(fn)
+} // end of dcc.verifySnapshot
+
+
+// ============================================================================================================================
+
+
+// Admin function.
+func (dcc *DecodedChainCode) exportLedger(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
+    var err error
+    snapshot, err := dcc.loadSnapshot(stub)
+    if err != nil {
+        utils.PrintErrorFull("exportLedger - loadSnapshot", err)
+        return nil, err
+    }
+    snapshotBytes, err := json.Marshal(&snapshot)
+    if err != nil {
+        utils.PrintErrorFull("exportLedger - Marshal", err)
+        return nil, err
+    }
+    utils.PrintSuccess("Exported the ledger")
+    return snapshotBytes, nil
+} // end of dcc.exportLedger
+
+
+// Admin function. Args: the snapshot as returned by exportLedger.
+func (dcc *DecodedChainCode) importLedger(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
+    var err error
+    var snapshot LedgerSnapshot
+    if err = dcc.decodeJSONArgument(fn, args, &snapshot); err != nil {
+        utils.PrintErrorFull("importLedger - decodeJSONArgument", err)
+        return nil, err
+    }
+    if err = dcc.verifySnapshot(fn, snapshot); err != nil {
+        utils.PrintErrorFull("importLedger - verifySnapshot", err)
+        return nil, err
+    }
+    if violations := verifyInvariants(snapshot.LedgerData); len(violations) > 0 {
+        chaincodeErr := newChaincodeError(ERRINVARIANTSVIOLATED, fn, "The snapshot breaks " + strconv.Itoa(len(violations)) + " ledger invariants")
+        for _, violation := range violations {
+            chaincodeErr.withDetail(violation.Rule + " " + violation.Entity + " " + violation.Id, violation.Detail)
+        }
+        utils.PrintErrorFull("", chaincodeErr)
+        return nil, chaincodeErr
+    }
+    isEmpty, err := dcc.isLedgerEmpty(stub)
+    if err != nil {
+        utils.PrintErrorFull("importLedger - isLedgerEmpty", err)
+        return nil, err
+    }
+    if isEmpty == false {
+        err = newChaincodeError(ERRLEDGERNOTEMPTY, fn, "A snapshot can only be imported into an empty ledger")
+        utils.PrintErrorFull("", err)
+        return nil, err
+    }
+    // Records are written in the order of their ids.
+    report := ImportReport{ Imported: make(map[string]int) }
+    write := func(entityType string, key string, v interface{}) (error) {
+        recordBytes, err := json.Marshal(v)
+        if err != nil {
+            return err
+        }
+        report.Imported[entityType] = report.Imported[entityType] + 1
+        return stub.PutState(key, recordBytes)
+    }
+    ids := map[string]bool{}
+    for id := range snapshot.Owners {
+        ids[id] = true
+    }
+    for _, id := range sortedKeys(ids) {
+        owner := snapshot.Owners[id]
+        if err = write("owner", ownerKey(id), &owner); err != nil {
+            utils.PrintErrorFull("importLedger - write owner", err)
+            return nil, err
+        }
+    }
+    ids = map[string]bool{}
+    for id := range snapshot.Assets {
+        ids[id] = true
+    }
+    for _, id := range sortedKeys(ids) {
+        asset := snapshot.Assets[id]
+        if err = write("asset", assetKey(id), &asset); err != nil {
+            utils.PrintErrorFull("importLedger - write asset", err)
+            return nil, err
+        }
+    }
+    ids = map[string]bool{}
+    for id := range snapshot.Transactions {
+        ids[id] = true
+    }
+    for _, id := range sortedKeys(ids) {
+        transaction := snapshot.Transactions[id]
+        if err = write("transaction", transactionKey(id), &transaction); err != nil {
+            utils.PrintErrorFull("importLedger - write transaction", err)
+            return nil, err
+        }
+    }
+    ids = map[string]bool{}
+    for ledgerName := range snapshot.Ledgers {
+        ids[ledgerName] = true
+    }
+    for _, ledgerName := range sortedKeys(ids) {
+        for _, entry := range snapshot.Ledgers[ledgerName] {
+            if err = dcc.addToLedger(stub, ledgerName, entry); err != nil {
+                utils.PrintErrorFull("importLedger - addToLedger", err)
+                return nil, err
+            }
+            report.Imported["ledger"] = report.Imported["ledger"] + 1
+        }
+    }
+    if err = dcc.setSchemaVersion(stub, snapshot.SchemaVersion); err != nil {
+        utils.PrintErrorFull("importLedger - setSchemaVersion", err)
+        return nil, err
+    }
+    details := map[string]string{}
+    for entityType, count := range report.Imported {
+        details[entityType] = strconv.Itoa(count)
+    }
+    recordEvent(stub, EVENTLEDGERIMPORTED, "", details)
+    reportBytes, err := json.Marshal(&report)
+    if err != nil {
+        utils.PrintErrorFull("importLedger - Marshal", err)
+        return nil, err
+    }
+    utils.PrintSuccess("Imported the ledger")
+    return reportBytes, nil
+} // end of dcc.importLedger
+
+
+// ============================================================================================================================
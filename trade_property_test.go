@@ -0,0 +1,299 @@
+/*
+
+DECODED HYPERLEDGER APPLICATION
+
+Randomised tests of the trade engine. Sequences of trades (straight through and pending, by issuers and by other
+holders, for part or all of a holding), approvals and declines run against the in-memory stub. After every step:
+    - cash is conserved: the balances plus the escrow balances of all owners add up to what they started with.
+    - units are conserved: the holdings and escrow of every asset add up to its issued quantity.
+    - the ledger invariants hold (see invariants.go).
+Invokes the chaincode refuses, for example for an insufficient balance, are part of the sequence and must leave
+the ledger as it was.
+
+A failing sequence is shrunk before it is reported: steps are left out and quantities are lowered for as long as
+the sequence keeps failing. Run with -seed to repeat a sequence and -sequences to run more of them.
+
+*/
+
+
+package main
+
+
+import (
+    "flag"
+    "fmt"
+    "math"
+    "math/rand"
+    "strconv"
+    "strings"
+    "testing"
+)
+
+
+// ============================================================================================================================
+
+
+var propertySeed = flag.Int64("seed", 0, "run the single trade sequence with this seed")
+var propertySequences = flag.Int("sequences", 200, "number of random trade sequences")
+
+const SEQUENCELENGTH = 40
+
+// Owners that take part in the sequences, with the cash they start with.
+var PROPERTYOWNERS = []string{ "issuer1", "issuer2", "alice", "bob", "carol" }
+var PROPERTYBALANCES = []string{ "100", "0", "250.55", "99.9", "1000" }
+
+// Assets with their issuer, issued quantity, price and approval quantity. Prices are not exact in binary.
+var PROPERTYASSETS = [][]string{
+    { "pear", "issuer1", "500", "0.1", "20" },
+    { "plum", "issuer2", "37", "3.3", "5" },
+}
+
+
+const (
+    STEPTRADE   = "trade"
+    STEPAPPROVE = "approve"
+    STEPDECLINE = "decline"
+)
+
+
+// Indices are taken modulo the owners, assets or pending transactions when the step runs, so any step is valid
+// in any sequence and steps can be left out while shrinking.
+type propertyStep struct {
+    Kind        string
+    Asset       int
+    Seller      int
+    Buyer       int
+    Quantity    int
+    Pending     bool
+    Pick        int // Which pending transaction to approve or decline.
+}
+
+
+// ============================================================================================================================
+
+
+func (s propertyStep) String() (string) {
+    switch s.Kind {
+        case STEPTRADE:
+            asset := PROPERTYASSETS[s.Asset % len(PROPERTYASSETS)]
+            return fmt.Sprintf("trade %d %s from %s to %s at %s (pending requested: %v)", s.Quantity, asset[0],
+                PROPERTYOWNERS[s.Seller % len(PROPERTYOWNERS)], PROPERTYOWNERS[s.Buyer % len(PROPERTYOWNERS)], asset[3], s.Pending)
+        default:
+            return fmt.Sprintf("%s pending transaction #%d", s.Kind, s.Pick)
+    }
+}
+
+
+func formatSequence(steps []propertyStep) (string) {
+    lines := []string{}
+    for i, step := range steps {
+        lines = append(lines, fmt.Sprintf("  %d. %s", i + 1, step))
+    }
+    return strings.Join(lines, "\n")
+}
+
+
+// Half of the trades are sold by the issuer, so the holdings spread out early in the sequence.
+func randomSequence(random *rand.Rand, length int) ([]propertyStep) {
+    steps := []propertyStep{}
+    for len(steps) < length {
+        step := propertyStep{ Kind: STEPTRADE, Asset: random.Intn(len(PROPERTYASSETS)), Seller: random.Intn(len(PROPERTYOWNERS)),
+            Buyer: random.Intn(len(PROPERTYOWNERS)), Quantity: 1 + random.Intn(60), Pending: random.Intn(4) == 0, Pick: random.Intn(8) }
+        if random.Intn(2) == 0 {
+            step.Seller = step.Asset // The issuers and assets are listed in the same order.
+        }
+        switch roll := random.Intn(10); {
+            case roll < 2:
+                step.Kind = STEPAPPROVE
+            case roll < 4:
+                step.Kind = STEPDECLINE
+        }
+        steps = append(steps, step)
+    }
+    return steps
+}
+
+
+// ============================================================================================================================
+
+
+// Runs the sequence on a new ledger. Returns a description of the first failure, empty when there is none.
+func runSequence(steps []propertyStep) (string) {
+    dcc := new(DecodedChainCode)
+    stub := newMockStub()
+    if _, err := dcc.Init(stub, "init", []string{}); err != nil {
+        return "Init: " + err.Error()
+    }
+    stub.setAttribute(ADMINATTRIBUTE, ADMINROLE)
+    totalCash := 0.0
+    for i, ownerId := range PROPERTYOWNERS {
+        if _, err := dcc.Invoke(stub, "addOwner", []string{ ownerId, ownerId, PROPERTYBALANCES[i], "", "", "" }); err != nil {
+            return "addOwner: " + err.Error()
+        }
+        if _, err := dcc.Invoke(stub, "validateOwner", []string{ ownerId, "reviewer", TESTEXPIRY, "hash" }); err != nil {
+            return "validateOwner: " + err.Error()
+        }
+        balance, _ := strconv.ParseFloat(PROPERTYBALANCES[i], 64)
+        totalCash = totalCash + balance
+    }
+    for _, asset := range PROPERTYASSETS {
+        if _, err := dcc.Invoke(stub, "addAssetString", []string{ asset[0], asset[0], asset[1], asset[2], asset[3], "", "", "true", asset[4], "" }); err != nil {
+            return "addAssetString: " + err.Error()
+        }
+    }
+    stub.setAttribute(ADMINATTRIBUTE, "")
+    for i, step := range steps {
+        var err error
+        switch step.Kind {
+            case STEPTRADE:
+                asset := PROPERTYASSETS[step.Asset % len(PROPERTYASSETS)]
+                approvalRequired := "FALSE"
+                if step.Pending {
+                    approvalRequired = "TRUE"
+                }
+                _, err = dcc.Invoke(stub, "transactAsset", []string{ asset[0], PROPERTYOWNERS[step.Seller % len(PROPERTYOWNERS)],
+                    PROPERTYOWNERS[step.Buyer % len(PROPERTYOWNERS)], strconv.Itoa(step.Quantity), asset[3], approvalRequired })
+            default:
+                pending, ledgerErr := dcc.getDataArrayStrings(stub, PRIMARYKEY[3], []string{})
+                if ledgerErr != nil {
+                    return fmt.Sprintf("step %d: reading the pending transactions: %v", i + 1, ledgerErr)
+                }
+                if len(pending) == 0 {
+                    continue
+                }
+                fn := "approveTransaction"
+                if step.Kind == STEPDECLINE {
+                    fn = "declineTransaction"
+                }
+                transaction, ledgerErr := dcc.getTransaction(stub, []string{ pending[step.Pick % len(pending)] })
+                if ledgerErr != nil {
+                    return fmt.Sprintf("step %d: reading the pending transaction: %v", i + 1, ledgerErr)
+                }
+                asset, ledgerErr := dcc.getAsset(stub, []string{ transaction.AssetId })
+                if ledgerErr != nil {
+                    return fmt.Sprintf("step %d: reading the asset: %v", i + 1, ledgerErr)
+                }
+                stub.setAttribute(OWNERATTRIBUTE, asset.Issuer)
+                _, err = dcc.Invoke(stub, fn, []string{ transaction.Id })
+                stub.setAttribute(OWNERATTRIBUTE, "")
+        }
+        // Refusals are fine, failures of the chaincode itself are not.
+        if chaincodeErr, ok := err.(*ChaincodeError); err != nil && (ok == false || chaincodeErr.Code == ERRINTERNAL) {
+            return fmt.Sprintf("step %d: %v", i + 1, err)
+        }
+        if failure := checkConservation(dcc, stub, totalCash); failure != "" {
+            return fmt.Sprintf("step %d: %s", i + 1, failure)
+        }
+    }
+    return ""
+}
+
+
+func checkConservation(dcc *DecodedChainCode, stub *mockStub, totalCash float64) (string) {
+    data, err := dcc.loadLedgerData(stub)
+    if err != nil {
+        return "loading the ledger: " + err.Error()
+    }
+    cash := 0.0
+    for _, owner := range data.Owners {
+        cash = cash + owner.Balance + owner.EscrowBalance
+    }
+    if math.Abs(cash - totalCash) > BALANCETOLERANCE {
+        return fmt.Sprintf("cash is not conserved: the owners hold %v, they started with %v", cash, totalCash)
+    }
+    for assetId, asset := range data.Assets {
+        units := 0
+        for _, ownedBy := range asset.OwnedBy {
+            units = units + ownedBy.Quantity + ownedBy.EscrowQty
+        }
+        if units != asset.IssuedQty {
+            return fmt.Sprintf("units of %s are not conserved: %d held, %d issued", assetId, units, asset.IssuedQty)
+        }
+    }
+    if violations := verifyInvariants(data); len(violations) > 0 {
+        return fmt.Sprintf("ledger invariants broken: %+v", violations)
+    }
+    return ""
+}
+
+
+// ============================================================================================================================
+
+
+func shrinkSequence(steps []propertyStep) ([]propertyStep) {
+    return shrinkWith(steps, func(candidate []propertyStep) (bool) {
+        return runSequence(candidate) != ""
+    })
+}
+
+
+// Leaves out as many steps as it can, first in large chunks, then one at a time, and then lowers the quantities,
+// keeping every change after which the sequence still fails.
+func shrinkWith(steps []propertyStep, fails func([]propertyStep) (bool)) ([]propertyStep) {
+    for chunk := len(steps) / 2; chunk >= 1; chunk = chunk / 2 {
+        for start := 0; start + chunk <= len(steps); {
+            candidate := append(append([]propertyStep{}, steps[:start]...), steps[start + chunk:]...)
+            if fails(candidate) {
+                steps = candidate
+            } else {
+                start = start + chunk
+            }
+        }
+    }
+    for i := range steps {
+        for steps[i].Kind == STEPTRADE && steps[i].Quantity > 1 {
+            candidate := append([]propertyStep{}, steps...)
+            candidate[i].Quantity = candidate[i].Quantity / 2
+            if fails(candidate) == false {
+                break
+            }
+            steps = candidate
+        }
+    }
+    return steps
+}
+
+
+func TestTradeSequences(t *testing.T) {
+    seeds := []int64{}
+    if *propertySeed != 0 {
+        seeds = append(seeds, *propertySeed)
+    } else {
+        count := *propertySequences
+        if testing.Short() {
+            count = 20
+        }
+        for seed := int64(1); seed <= int64(count); seed++ {
+            seeds = append(seeds, seed)
+        }
+    }
+    for _, seed := range seeds {
+        steps := randomSequence(rand.New(rand.NewSource(seed)), SEQUENCELENGTH)
+        if failure := runSequence(steps); failure != "" {
+            shrunk := shrinkSequence(steps)
+            t.Fatalf("seed %d: %s\nshrunk to %d steps (%s):\n%s", seed, failure, len(shrunk), runSequence(shrunk), formatSequence(shrunk))
+        }
+    }
+}
+
+
+func TestShrinkSequence(t *testing.T) {
+    // A fake failure: any sequence with a trade of more than 10 plums fails.
+    steps := randomSequence(rand.New(rand.NewSource(7)), SEQUENCELENGTH)
+    steps = append(steps, propertyStep{ Kind: STEPTRADE, Asset: 1, Quantity: 40 })
+    fails := func(candidate []propertyStep) (bool) {
+        for _, step := range candidate {
+            if step.Kind == STEPTRADE && step.Asset % len(PROPERTYASSETS) == 1 && step.Quantity > 10 {
+                return true
+            }
+        }
+        return false
+    }
+    shrunk := shrinkWith(steps, fails)
+    if len(shrunk) != 1 || shrunk[0].Quantity <= 10 || shrunk[0].Quantity > 20 {
+        t.Fatalf("expected a single plum trade of 11 to 20 units, got:\n%s", formatSequence(shrunk))
+    }
+}
+
+
+// ============================================================================================================================
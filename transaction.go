@@ -10,17 +10,27 @@ Types of available transactions:
 
 DecodedChainCode functions:
 - createTransaction
+- uniqueTransactionId - private function
 - getTransaction
 - transactAsset
 - approveTransaction
 - declineTransaction
+- verifyApprover - private function
+- settleTransaction - private function
 - readAllTransactions
+- readPendingTransactions
+- parseTransactionFilter - private function
+- readOwnerTransactions
+- readAssetTransactions
 
 Transaction functions:
 - save
 - approve
 - rollback
 - removeFromPendingLedger
+- matches
+- escrowedAmount
+- eventDetails
 
 */
 
@@ -30,7 +40,7 @@ package main
 
 import (
     "encoding/json"
-    "errors"
+    "sort"
     "strconv"
     "time"
 
@@ -58,11 +68,53 @@ type Transaction struct {
     Created         int64       `json:"createdAt"`
     // Status
     Status          string      `json:"status"`
+    Escrowed        float64     `json:"escrowed"` // Funds the buyer has in escrow while the transaction is pending.
     // API related.
     APIFixing       string      `json:"apifixing"`
 }
 
 
+// A pending transaction as seen by the approvers.
+type PendingTransaction struct {
+    Transaction
+    AssetName       string      `json:"assetName"`
+    SellerName      string      `json:"sellerName"`
+    BuyerName       string      `json:"buyerName"`
+    EscrowedAmount  float64     `json:"escrowedAmount"`
+    EscrowedQty     int         `json:"escrowedQty"`
+    Age             int64       `json:"ageSeconds"`
+    Approver        string      `json:"approver"`
+    ApprovalReason  string      `json:"approvalReason"` // approvalQty: the asset requires it, requested: the trade asked for it.
+}
+
+
+// Filter for the transaction history queries. Side is relative to the owner: buy or sell.
+type TransactionFilter struct {
+    Status          string      `json:"status"`
+    Side            string      `json:"side"`
+    Owner           string      `json:"owner"`
+}
+
+
+// Sorts transactions by creation time, oldest first.
+type transactionsByTime []Transaction
+
+func (t transactionsByTime) Len() int { return len(t) }
+func (t transactionsByTime) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t transactionsByTime) Less(i, j int) bool {
+    if t[i].Created == t[j].Created {
+        return t[i].Id < t[j].Id
+    }
+    return t[i].Created < t[j].Created
+}
+
+
+// Each asset has a ledger of its transactions.
+func assetTransactionsLedger(assetId string) (string) {
+    return "AssetTransactions" + KEYSEPARATOR + assetId
+}
+
+
 // ============================================================================================================================
 
 
@@ -72,7 +124,7 @@ func (tx *Transaction) save(stub shim.ChaincodeStubInterface) (error) {
     if err != nil {
         return err
     }
-    err = stub.PutState(tx.Id, transactionBytesToWrite)
+    err = stub.PutState(transactionKey(tx.Id), transactionBytesToWrite)
     if err != nil {
         return err
     }
@@ -85,7 +137,7 @@ func (tx *Transaction) approve(stub shim.ChaincodeStubInterface, dcc *DecodedCha
     var buyer, seller Owner
     var asset Asset
     if tx.Status != "Pending" {
-        err = errors.New("{\"Error\":\"Trying to roll back a non-pending transaction (" + tx.Id + ")\"}")
+        err = newChaincodeError(ERRNOTPENDING, "approve", "Transaction " + tx.Id + " is not pending").withDetail("transactionId", tx.Id).withDetail("status", tx.Status)
         return err
     }
     // Get the structs needed
@@ -101,15 +153,21 @@ func (tx *Transaction) approve(stub shim.ChaincodeStubInterface, dcc *DecodedCha
     if err != nil {
         return err
     }
+    if err = buyer.isActive("approve"); err != nil {
+        return err
+    }
+    if err = seller.isActive("approve"); err != nil {
+        return err
+    }
     // Process the approval.
     // 1. Buyer: Take the buyer escrow money and add the asset if needed.
-    buyer.approveBuyTransaction(tx.AssetId, tx.Price * float64(tx.Quantity))
+    buyer.approveBuyTransaction(tx.AssetId, tx.escrowedAmount())
     err = buyer.save(stub)
     if err != nil {
         return err
     }
     // 2. Seller, give him the funds and take the asset off his ledger.
-    seller.approveSellTransaction(&asset, tx.Price * float64(tx.Quantity), tx.Quantity)
+    seller.approveSellTransaction(&asset, tx.escrowedAmount(), tx.Quantity)
     err = seller.save(stub)
     if err != nil {
         return err
@@ -133,7 +191,7 @@ func (tx *Transaction) rollback(stub shim.ChaincodeStubInterface, dcc *DecodedCh
     var buyer Owner
     var asset Asset
     if tx.Status != "Pending" {
-        err = errors.New("{\"Error\":\"Trying to roll back a non-pending transaction (" + tx.Id + ")\"}")
+        err = newChaincodeError(ERRNOTPENDING, "rollback", "Transaction " + tx.Id + " is not pending").withDetail("transactionId", tx.Id).withDetail("status", tx.Status)
         return err
     }
     // Rollback the buyer escrow money
@@ -141,7 +199,7 @@ func (tx *Transaction) rollback(stub shim.ChaincodeStubInterface, dcc *DecodedCh
     if err != nil {
         return err
     }
-    buyer.rollbackBuyTransaction(tx.Price * float64(tx.Quantity))
+    buyer.rollbackBuyTransaction(tx.escrowedAmount())
     err = buyer.save(stub)
     if err != nil {
         return err
@@ -164,13 +222,8 @@ func (tx *Transaction) rollback(stub shim.ChaincodeStubInterface, dcc *DecodedCh
 
 func (tx *Transaction) removeFromPendingLedger(stub shim.ChaincodeStubInterface, dcc *DecodedChainCode) (error) {
     var err error
-    var pendingTransactionsLedger, emptyArgs []string
-    // Get the pending ledger
-    pendingTransactionsLedger, err = dcc.getDataArrayStrings(stub, PRIMARYKEY[3], emptyArgs)
     // Remove transaction id
-    pendingTransactionsLedger = utils.DeleteElementFromSlice(pendingTransactionsLedger, tx.Id)
-    // Save.
-    err = dcc.saveLedger(stub, PRIMARYKEY[3], pendingTransactionsLedger)
+    err = dcc.removeFromLedger(stub, PRIMARYKEY[3], tx.Id)
     if err != nil {
         return err
     }
@@ -178,6 +231,40 @@ func (tx *Transaction) removeFromPendingLedger(stub shim.ChaincodeStubInterface,
 }
 
 
+func (tx *Transaction) matches(filter TransactionFilter) (bool) {
+    if filter.Status != "" && tx.Status != filter.Status {
+        return false
+    }
+    if filter.Side == "buy" && tx.BuyerId != filter.Owner {
+        return false
+    }
+    if filter.Side == "sell" && tx.SellerId != filter.Owner {
+        return false
+    }
+    return true
+}
+
+
+// Transactions from before the escrow was recorded escrowed the undiscounted amount.
+func (tx *Transaction) escrowedAmount() (float64) {
+    if tx.Escrowed != 0 || tx.Discount >= 100.0 {
+        return tx.Escrowed
+    }
+    return tx.Price * float64(tx.Quantity) / (1.0 - tx.Discount / 100.0)
+}
+
+
+func (tx *Transaction) eventDetails() (map[string]string) {
+    return map[string]string{
+        "assetId": tx.AssetId,
+        "sellerId": tx.SellerId,
+        "buyerId": tx.BuyerId,
+        "quantity": strconv.Itoa(tx.Quantity),
+        "price": formatAmount(tx.Price),
+    }
+}
+
+
 // ============================================================================================================================
 
 
@@ -185,7 +272,7 @@ func (dcc *DecodedChainCode) createTransaction(quantity int, price float64, args
     var err error
     var transaction Transaction
     if len(args) != 3 { // assetId, sellerId, buyerId
-        err = errors.New("{\"Error\":\"Incorrect number of arguments\", \"Function\":\"createTransaction\"}")
+        err = argumentCountError("createTransaction")
         utils.PrintErrorFull("", err)
         return transaction, err
     }
@@ -211,18 +298,35 @@ func (dcc *DecodedChainCode) createTransaction(quantity int, price float64, args
 }
 
 
+// Trades of the same asset between the same owners in the same second hash to the same id; the later ones get
+// the id hashed again with a counter, so no transaction overwrites another.
+func (dcc *DecodedChainCode) uniqueTransactionId(stub shim.ChaincodeStubInterface, transactionId string) (string, error) {
+    candidate := transactionId
+    for i := 1; ; i++ {
+        existingBytes, err := stub.GetState(transactionKey(candidate))
+        if err != nil {
+            return "", err
+        }
+        if existingBytes == nil {
+            return candidate, nil
+        }
+        candidate = utils.HashSHA256(transactionId + "-" + strconv.Itoa(i))
+    }
+}
+
+
 func (dcc *DecodedChainCode) getTransaction(stub shim.ChaincodeStubInterface, args []string) (Transaction, error) {
     var transaction Transaction
     var err error
     if len(args) != 1 { // Only needs an transaction id.
-        err = errors.New("{\"Error\":\"Incorrect number of arguments\", \"Function\":\"getTransaction\"}")
+        err = argumentCountError("getTransaction")
         utils.PrintErrorFull("", err)
         return transaction, err
     }
     transactionId := args[0]
-    transactionBytes, err := stub.GetState(transactionId)
+    transactionBytes, err := stub.GetState(transactionKey(transactionId))
     if transactionBytes == nil {
-        err = errors.New("{\"Error\":\"State " + transactionId + " does not exist\", \"Function\":\"getTransaction\"}")
+        err = newChaincodeError(ERRNOTFOUND, "getTransaction", "Transaction " + transactionId + " does not exist").withDetail("transactionId", transactionId)
         utils.PrintErrorFull("", err)
         return transaction, err
     }
@@ -240,14 +344,8 @@ func (dcc *DecodedChainCode) getTransaction(stub shim.ChaincodeStubInterface, ar
 
 func (dcc *DecodedChainCode) transactAsset(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
     var err error
-    var emptyArgs []string
     var transaction Transaction
     // Check for the appropriate number of inputs: assetName, fromName, toName, quantity, forAmount, approvalNeeded
-    if len(args) != 6 {
-        err = errors.New("{\"Error\":\"Incorrect number of arguments\", \"Function\":\"" + fn + "\"}")
-        utils.PrintErrorFull("", err)
-        return nil, err
-    }
     // ----------------------------------------------
     // Handle the inputs.
     assetId := args[0]
@@ -255,16 +353,41 @@ func (dcc *DecodedChainCode) transactAsset(stub shim.ChaincodeStubInterface, fn
     buyerId := args[2]
     quantity, err := strconv.Atoi(args[3]) // Convert string to int.
     if err != nil {
+        err = newChaincodeError(ERRINVALIDARGUMENTS, fn, "Quantity must be a whole number").withDetail("quantity", "must be a whole number")
         utils.PrintErrorFull("transactAsset - Atoi", err)
         return nil, err
     }
     price, err := strconv.ParseFloat(args[4], 64) // Convert string to float64.
     if err != nil {
+        err = newChaincodeError(ERRINVALIDARGUMENTS, fn, "Price must be a number").withDetail("price", "must be a number")
         utils.PrintErrorFull("transactAsset - ParseFloat", err)
         return nil, err
     }
+    // The JSON variant passes its arguments on to here, so the checks on the values are shared.
+    fieldErrors := FieldErrors{}
+    if quantity <= 0 {
+        fieldErrors["quantity"] = "must be positive"
+    }
+    if price < 0 {
+        fieldErrors["price"] = "must not be negative"
+    }
+    if err = fieldErrors.toError(fn); err != nil {
+        utils.PrintErrorFull("", err)
+        return nil, err
+    }
     forAmount := price * float64(quantity);
     approvalRequired := args[5]
+    // Both sides of a trade are loaded and saved separately, an owner trading with itself would be saved twice.
+    if sellerId == buyerId {
+        err = newChaincodeError(ERRINVALIDARGUMENTS, fn, "Seller and buyer must be different owners").withDetail("buyerId", "must differ from the seller")
+        utils.PrintErrorFull("", err)
+        return nil, err
+    }
+    // Nothing can be traded while the market or the asset is halted.
+    if err = dcc.verifyTradingActive(stub, assetId, fn); err != nil {
+        utils.PrintErrorFull("transactAsset - verifyTradingActive", err)
+        return nil, err
+    }
     // ----------------------------------------------
     // Check the existence of the asset and owners.
     asset, err := dcc.getAsset(stub, []string{ assetId })
@@ -283,7 +406,7 @@ func (dcc *DecodedChainCode) transactAsset(stub shim.ChaincodeStubInterface, fn
         return nil, err
     }
     // Trigger for approval...
-    if asset.Triggers.Approval == true && quantity > asset.Triggers.ApprovalQty {
+    if asset.needsApproval(quantity) {
         approvalRequired = "TRUE"
     }
     // ----------------------------------------------
@@ -297,26 +420,34 @@ func (dcc *DecodedChainCode) transactAsset(stub shim.ChaincodeStubInterface, fn
         utils.PrintErrorFull("transactAsset - isValidated", err)
         return nil, err
     }
+    if err = seller.isActive(fn); err != nil {
+        utils.PrintErrorFull("transactAsset - isActive", err)
+        return nil, err
+    }
+    if err = buyer.isActive(fn); err != nil {
+        utils.PrintErrorFull("transactAsset - isActive", err)
+        return nil, err
+    }
     // 2. Check if the current owner actually owns the asset.
     checkAsset := utils.IsElementInSlice(asset.Owners, sellerId)
     checkOwner := utils.IsElementInSlice(seller.Assets, asset.Id)
     if checkAsset == false || checkOwner == false {
-        err = errors.New("Ownership issues.")
+        err = newChaincodeError(ERROWNERSHIPMISMATCH, fn, "Seller " + sellerId + " does not hold asset " + assetId).withDetail("ownerId", sellerId).withDetail("assetId", assetId)
         utils.PrintErrorFull("transactAsset", err)
         return nil, err
     }
     // 3. Check the balance is enough to pay the forAmount.
-    if err = buyer.verifyBalance(forAmount); err != nil {
+    if err = buyer.verifyBalance(fn, forAmount); err != nil {
         utils.PrintErrorFull("transactAsset - verifyBalance", err)
         return nil, err
     }
     // 4. Check if the owner owns enough of the asset.
-    if err = asset.verifyHoldings(sellerId, quantity); err != nil {
+    if err = asset.verifyHoldings(fn, sellerId, quantity); err != nil {
         utils.PrintErrorFull("transactAsset - verifyHoldings", err)
         return nil, err
     }
     // 5. Check if the asset price is right
-    if err = asset.verifyPrice(price); err != nil {
+    if err = asset.verifyPrice(fn, price); err != nil {
         utils.PrintErrorFull("transactAsset - verifyPrice", err)
         return nil, err
     }
@@ -327,10 +458,8 @@ func (dcc *DecodedChainCode) transactAsset(stub shim.ChaincodeStubInterface, fn
         utils.PrintErrorFull("transactAsset - createTransaction", err)
         return nil, err
     }
-    // Load the current transactionsLedger
-    transactionsLedger, err := dcc.getDataArrayStrings(stub, PRIMARYKEY[2], emptyArgs)
-    if err != nil {
-        utils.PrintErrorFull("transactAsset - getDataArrayStrings", err)
+    if transaction.Id, err = dcc.uniqueTransactionId(stub, transaction.Id); err != nil {
+        utils.PrintErrorFull("transactAsset - uniqueTransactionId", err)
         return nil, err
     }
     // ----------------------------------------------
@@ -342,11 +471,13 @@ func (dcc *DecodedChainCode) transactAsset(stub shim.ChaincodeStubInterface, fn
         // Parse the value and fixing
         val, err := strconv.ParseFloat(asset.Contract.Value, 64)
         if err != nil {
+            err = newChaincodeError(ERRORACLEFAILURE, fn, "Contract value of asset " + asset.Id + " is not a number").withDetail("value", asset.Contract.Value)
             utils.PrintErrorFull("transactAsset - ParseFloat", err)
             return nil, err
         }
         fix, err := strconv.ParseFloat(fixing, 64)
         if err != nil {
+            err = newChaincodeError(ERRORACLEFAILURE, fn, "Fixing from " + asset.Contract.URL + " is not a number").withDetail("fixing", fixing)
             utils.PrintErrorFull("transactAsset - ParseFloat", err)
             return nil, err
         }
@@ -370,6 +501,7 @@ func (dcc *DecodedChainCode) transactAsset(stub shim.ChaincodeStubInterface, fn
         // Update the price.
         price = price * (1.0 - transaction.Discount / 100.0)
         transaction.Price = price
+        forAmount = price * float64(quantity)
     }
     // ----------------------------------------------
     // Some things have to happen regardless of the transaction requires approval
@@ -383,17 +515,12 @@ func (dcc *DecodedChainCode) transactAsset(stub shim.ChaincodeStubInterface, fn
     if approvalRequired == "TRUE" { // Process the pending transaction
         // Escrow the funds
         buyer.EscrowBalance = buyer.EscrowBalance + forAmount
+        transaction.Escrowed = forAmount
         // Update the asset. Change the ownership to escrow for the quantity.
         asset.escrowOwner(sellerId, quantity)
         // Save in pending transactions
-        pendingTransactionsLedger, err := dcc.getDataArrayStrings(stub, PRIMARYKEY[3], emptyArgs)
-        if err != nil {
-            utils.PrintErrorFull("transactAsset - getDataArrayStrings", err)
-            return nil, err
-        }
-        _, err = dcc.saveStringToDataArray(stub, PRIMARYKEY[3], transaction.Id, pendingTransactionsLedger)
-        if err != nil {
-            utils.PrintErrorFull("transactAsset - saveStringToDataArray", err)
+        if err = dcc.addToLedger(stub, PRIMARYKEY[3], transaction.Id); err != nil {
+            utils.PrintErrorFull("transactAsset - addToLedger", err)
             return nil, err
         }
         transaction.Status = "Pending"
@@ -424,31 +551,48 @@ func (dcc *DecodedChainCode) transactAsset(stub shim.ChaincodeStubInterface, fn
         utils.PrintErrorFull("transactAsset - save", err)
         return nil, err
     }
-    _, err = dcc.saveStringToDataArray(stub, PRIMARYKEY[2], transaction.Id, transactionsLedger)
-    if err != nil {
-        utils.PrintErrorFull("transactAsset - saveStringToDataArray", err)
+    if err = dcc.addToLedger(stub, PRIMARYKEY[2], transaction.Id); err != nil {
+        utils.PrintErrorFull("transactAsset - addToLedger", err)
         return nil, err
     }
+    if err = dcc.addToLedger(stub, assetTransactionsLedger(assetId), transaction.Id); err != nil {
+        utils.PrintErrorFull("transactAsset - addToLedger", err)
+        return nil, err
+    }
+    if transaction.Status == "Validated" {
+        if err = dcc.settleTransaction(stub, transaction); err != nil {
+            utils.PrintErrorFull("transactAsset - settleTransaction", err)
+            return nil, err
+        }
+    }
     // ----------------------------------------------
+    eventType := EVENTTRADEVALIDATED
+    if transaction.Status == "Pending" {
+        eventType = EVENTTRADEPENDING
+    }
+    recordEvent(stub, eventType, transaction.Id, transaction.eventDetails())
     utils.PrintSuccess("Transacted asset `" + assetId + "` from owner `" + sellerId + "` to owner `" + buyerId + "`")
-    return nil, nil
+    return dcc.tradeResult(stub, fn, transaction)
 }
 
 
 // Approve pending transaction
 func (dcc *DecodedChainCode) approveTransaction(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
     var err error
-    if len(args) != 1 { // Only needs a transactionId
-        err = errors.New("{\"Error\":\"Incorrect number of arguments\", \"Function\":\"" + fn + "\"}")
-        utils.PrintErrorFull("", err)
-        return nil, err
-    }
     // Get the transaction
     transaction, err := dcc.getTransaction(stub, []string{ args[0] })
     if err != nil {
         utils.PrintErrorFull("approveTransaction - getTransaction", err)
         return nil, err
     }
+    if err = dcc.verifyApprover(stub, fn, transaction); err != nil {
+        utils.PrintErrorFull("approveTransaction - verifyApprover", err)
+        return nil, err
+    }
+    if err = dcc.verifyTradingActive(stub, transaction.AssetId, fn); err != nil {
+        utils.PrintErrorFull("approveTransaction - verifyTradingActive", err)
+        return nil, err
+    }
     // Finalise the escrow for buyer, seller, and asset.
     if err = transaction.approve(stub, dcc); err != nil {
         utils.PrintErrorFull("approveTransaction - approve", err)
@@ -464,25 +608,33 @@ func (dcc *DecodedChainCode) approveTransaction(stub shim.ChaincodeStubInterface
         utils.PrintErrorFull("approveTransaction - removeFromPendingLedger", err)
         return nil, err
     }
+    if err = dcc.settleTransaction(stub, transaction); err != nil {
+        utils.PrintErrorFull("approveTransaction - settleTransaction", err)
+        return nil, err
+    }
+    recordEvent(stub, EVENTTRADEAPPROVED, transaction.Id, transaction.eventDetails())
     utils.PrintSuccess("Approved transaction (" + transaction.Id + ") of asset `" + transaction.AssetId + "` from owner `" + transaction.SellerId + "` to owner `" + transaction.BuyerId + "`")
-    return nil, nil
+    return dcc.tradeResult(stub, fn, transaction)
 }
 
 
 // Decline a pending transaction
 func (dcc *DecodedChainCode) declineTransaction(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
     var err error
-    if len(args) != 1 { // Only needs a transactionId
-        err = errors.New("{\"Error\":\"Incorrect number of arguments\", \"Function\":\"" + fn + "\"}")
-        utils.PrintErrorFull("", err)
-        return nil, err
-    }
     // Get the transaction
     transaction, err := dcc.getTransaction(stub, []string{ args[0] })
     if err != nil {
         utils.PrintErrorFull("declineTransaction - getTransaction", err)
         return nil, err
     }
+    if err = dcc.verifyApprover(stub, fn, transaction); err != nil {
+        utils.PrintErrorFull("declineTransaction - verifyApprover", err)
+        return nil, err
+    }
+    if err = dcc.verifyTradingActive(stub, transaction.AssetId, fn); err != nil {
+        utils.PrintErrorFull("declineTransaction - verifyTradingActive", err)
+        return nil, err
+    }
     // Rollback the full transaction
     if err = transaction.rollback(stub, dcc); err != nil {
         utils.PrintErrorFull("declineTransaction - rollback", err)
@@ -499,51 +651,262 @@ func (dcc *DecodedChainCode) declineTransaction(stub shim.ChaincodeStubInterface
         return nil, err
     }
     // ----------------------------------------------
+    recordEvent(stub, EVENTTRADEDECLINED, transaction.Id, transaction.eventDetails())
     utils.PrintSuccess("Declined transaction (" + transaction.Id + ") of asset `" + transaction.AssetId + "` from owner `" + transaction.SellerId + "` to owner `" + transaction.BuyerId + "`")
-    return nil, nil
+    return dcc.tradeResult(stub, fn, transaction)
+}
+
+
+// Only the owner that can approve trades in the asset decides on its pending transactions. The caller is the owner
+// named in its certificate attributes.
+func (dcc *DecodedChainCode) verifyApprover(stub shim.ChaincodeStubInterface, fn string, transaction Transaction) (error) {
+    callerId, err := stub.ReadCertAttribute(OWNERATTRIBUTE)
+    if err != nil || len(callerId) == 0 {
+        err = newChaincodeError(ERRNOTAPPROVER, fn, "Caller carries no owner id").withDetail("assetId", transaction.AssetId)
+        return err
+    }
+    approverId := string(callerId)
+    asset, err := dcc.getAsset(stub, []string{ transaction.AssetId })
+    if err != nil {
+        return err
+    }
+    if asset.canApprove(approverId) == false {
+        err = newChaincodeError(ERRNOTAPPROVER, fn, "Owner " + approverId + " cannot approve trades in asset " + asset.Id).withDetail("approverId", approverId).withDetail("assetId", asset.Id)
+        return err
+    }
+    return nil
+} // end of dcc.verifyApprover
+
+
+// Runs once a trade has settled, validated straight away or approved, and the owners and asset are saved.
+func (dcc *DecodedChainCode) settleTransaction(stub shim.ChaincodeStubInterface, transaction Transaction) (error) {
+    var err error
+    if err = dcc.updatePositions(stub, transaction); err != nil {
+        utils.PrintErrorFull("settleTransaction - updatePositions", err)
+        return err
+    }
+    if err = dcc.updateMarketData(stub, transaction); err != nil {
+        utils.PrintErrorFull("settleTransaction - updateMarketData", err)
+        return err
+    }
+    return nil
 }
 
 
+// Function to read a page of transactions.
+// Optional JSON argument, see query.go. Filters: status, owner (buyer or seller), from and to (creation date).
 func (dcc *DecodedChainCode) readAllTransactions(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
+    var err error
+    query, err := dcc.parseListQuery(fn, args, []string{ "status", "owner", "from", "to" })
+    if err != nil {
+        utils.PrintErrorFull("readAllTransactions - parseListQuery", err)
+        return nil, err
+    }
+    page, err := dcc.readPage(stub, PRIMARYKEY[2], query, func(transactionId string) (interface{}, error) {
+        transaction, err := dcc.getTransaction(stub, []string{ transactionId })
+        if err != nil {
+            return nil, err
+        }
+        if query.Status != "" && transaction.Status != query.Status {
+            return nil, nil
+        }
+        if query.Owner != "" && transaction.SellerId != query.Owner && transaction.BuyerId != query.Owner {
+            return nil, nil
+        }
+        if query.inDateRange(transaction.Created) == false {
+            return nil, nil
+        }
+        return transaction, nil
+    })
+    if err != nil {
+        utils.PrintErrorFull("readAllTransactions - readPage", err)
+        return nil, err
+    }
+    pageBytes, err := json.Marshal(&page)
+    if err != nil {
+        utils.PrintErrorFull("readAllTransactions - Marshal", err)
+        return nil, err
+    }
+    utils.PrintSuccess("Retrieved a page of transactions.")
+    return pageBytes, nil
+}
+
+
+// Function to read a page of pending transactions with what the approvers need to decide on them.
+// Optional JSON argument, see query.go. Filters: owner (buyer or seller), approver (transactions the owner can approve),
+// from and to (creation date).
+func (dcc *DecodedChainCode) readPendingTransactions(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
+    var err error
+    query, err := dcc.parseListQuery(fn, args, []string{ "owner", "approver", "from", "to" })
+    if err != nil {
+        utils.PrintErrorFull("readPendingTransactions - parseListQuery", err)
+        return nil, err
+    }
+    now := time.Now().Unix()
+    page, err := dcc.readPage(stub, PRIMARYKEY[3], query, func(transactionId string) (interface{}, error) {
+        transaction, err := dcc.getTransaction(stub, []string{ transactionId })
+        if err != nil {
+            return nil, err
+        }
+        if transaction.Status != "Pending" {
+            return nil, nil
+        }
+        if query.Owner != "" && transaction.SellerId != query.Owner && transaction.BuyerId != query.Owner {
+            return nil, nil
+        }
+        if query.inDateRange(transaction.Created) == false {
+            return nil, nil
+        }
+        asset, err := dcc.getAsset(stub, []string{ transaction.AssetId })
+        if err != nil {
+            return nil, err
+        }
+        if query.Approver != "" && asset.canApprove(query.Approver) == false {
+            return nil, nil
+        }
+        seller, err := dcc.getOwner(stub, []string{ transaction.SellerId })
+        if err != nil {
+            return nil, err
+        }
+        buyer, err := dcc.getOwner(stub, []string{ transaction.BuyerId })
+        if err != nil {
+            return nil, err
+        }
+        pending := PendingTransaction{
+            Transaction: transaction,
+            AssetName: asset.Name,
+            SellerName: seller.Name,
+            BuyerName: buyer.Name,
+            EscrowedAmount: transaction.escrowedAmount(),
+            EscrowedQty: transaction.Quantity,
+            Age: now - transaction.Created,
+            Approver: asset.Issuer,
+            ApprovalReason: "requested",
+        }
+        if asset.needsApproval(transaction.Quantity) {
+            pending.ApprovalReason = "approvalQty"
+        }
+        return pending, nil
+    })
+    if err != nil {
+        utils.PrintErrorFull("readPendingTransactions - readPage", err)
+        return nil, err
+    }
+    pageBytes, err := json.Marshal(&page)
+    if err != nil {
+        utils.PrintErrorFull("readPendingTransactions - Marshal", err)
+        return nil, err
+    }
+    utils.PrintSuccess("Retrieved a page of pending transactions.")
+    return pageBytes, nil
+}
+
+
+// Parses the optional filter argument of the transaction history queries.
+func (dcc *DecodedChainCode) parseTransactionFilter(fn string, args []string) (TransactionFilter, error) {
+    var err error
+    var filter TransactionFilter
+    if len(args) == 1 {
+        if err = dcc.decodeJSONArgument(fn, args, &filter); err != nil {
+            return filter, err
+        }
+    }
+    fieldErrors := FieldErrors{}
+    if utils.IsElementInSlice([]string{ "", "Pending", "Validated", "Approved", "Declined" }, filter.Status) == false {
+        fieldErrors["status"] = "must be one of Pending, Validated, Approved or Declined"
+    }
+    if utils.IsElementInSlice([]string{ "", "buy", "sell" }, filter.Side) == false {
+        fieldErrors["side"] = "must be buy or sell"
+    }
+    return filter, fieldErrors.toError(fn)
+}
+
+
+// Returns the full transactions of an owner, oldest first. Optional JSON argument: {"status":"...", "side":"buy|sell"}
+func (dcc *DecodedChainCode) readOwnerTransactions(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
+    var err error
+    ownerId := args[0]
+    filter, err := dcc.parseTransactionFilter(fn, args[1:])
+    if err != nil {
+        utils.PrintErrorFull("readOwnerTransactions - parseTransactionFilter", err)
+        return nil, err
+    }
+    filter.Owner = ownerId
+    owner, err := dcc.getOwner(stub, []string{ ownerId })
+    if err != nil {
+        utils.PrintErrorFull("readOwnerTransactions - getOwner", err)
+        return nil, err
+    }
+    transactions := []Transaction{}
+    for _, transactionId := range owner.Transactions {
+        transaction, err := dcc.getTransaction(stub, []string{ transactionId })
+        if err != nil {
+            utils.PrintErrorFull("readOwnerTransactions - getTransaction", err)
+            return nil, err
+        }
+        if transaction.matches(filter) {
+            transactions = append(transactions, transaction)
+        }
+    }
+    sort.Sort(transactionsByTime(transactions))
+    transactionsBytes, err := json.Marshal(&transactions)
+    if err != nil {
+        utils.PrintErrorFull("readOwnerTransactions - Marshal", err)
+        return nil, err
+    }
+    utils.PrintSuccess("Retrieved the transactions of owner " + ownerId)
+    return transactionsBytes, nil
+}
+
+
+// Returns the full transactions of an asset, oldest first.
+// Optional JSON argument: {"status":"...", "side":"buy|sell", "owner":"..."}, a side needs the owner it is relative to.
+func (dcc *DecodedChainCode) readAssetTransactions(stub shim.ChaincodeStubInterface, fn string, args []string) ([]byte, error) {
     var err error
     var emptyArgs []string
-    if len(args) != 0 {
-        err = errors.New("{\"Error\":\"Incorrect number of arguments\", \"Function\":\"" + fn + "\"}")
+    assetId := args[0]
+    filter, err := dcc.parseTransactionFilter(fn, args[1:])
+    if err != nil {
+        utils.PrintErrorFull("readAssetTransactions - parseTransactionFilter", err)
+        return nil, err
+    }
+    if filter.Side != "" && filter.Owner == "" {
+        err = newChaincodeError(ERRINVALIDARGUMENTS, fn, "Invalid arguments").withDetail("owner", "is required with side")
         utils.PrintErrorFull("", err)
         return nil, err
     }
-    // Get all transactions - returns an slice of strings - transactionIds
-    transactionsLedger, err := dcc.getDataArrayStrings(stub, PRIMARYKEY[2], emptyArgs)
+    if _, err = dcc.getAsset(stub, []string{ assetId }); err != nil {
+        utils.PrintErrorFull("readAssetTransactions - getAsset", err)
+        return nil, err
+    }
+    transactionIds, err := dcc.getDataArrayStrings(stub, assetTransactionsLedger(assetId), emptyArgs)
     if err != nil {
-        utils.PrintErrorFull("readAllTransactions - getDataArrayStrings", err)
+        utils.PrintErrorFull("readAssetTransactions - getDataArrayStrings", err)
         return nil, err
     }
-    if len(transactionsLedger) > 0 {
-        // Initialise an empty slice for the output
-        var fullTransactionsLedger []Transaction
-        // Iterate over all transactions and return the transaction object.
-        for _, transactionId := range transactionsLedger {
-            thisTransaction, err := dcc.getTransaction(stub, []string{ transactionId })
-            if err != nil {
-                utils.PrintErrorFull("readAllTransactions - getTransaction", err)
-                return nil, err
-            }
-            fullTransactionsLedger = append(fullTransactionsLedger, thisTransaction)
-        }
-        // This gives us an slice with transactions. Translate to bytes and return
-        fullTransactionsLedgerBytes, err := json.Marshal(&fullTransactionsLedger)
+    transactions := []Transaction{}
+    for _, transactionId := range transactionIds {
+        transaction, err := dcc.getTransaction(stub, []string{ transactionId })
         if err != nil {
-            utils.PrintErrorFull("readAllTransactions - Marshal", err)
+            utils.PrintErrorFull("readAssetTransactions - getTransaction", err)
             return nil, err
         }
-        utils.PrintSuccess("Retrieved full information for all transactions.")
-        return fullTransactionsLedgerBytes, nil
-    } else {
-        return nil, nil
+        if filter.Owner != "" && filter.Side == "" && transaction.SellerId != filter.Owner && transaction.BuyerId != filter.Owner {
+            continue
+        }
+        if transaction.matches(filter) {
+            transactions = append(transactions, transaction)
+        }
+    }
+    sort.Sort(transactionsByTime(transactions))
+    transactionsBytes, err := json.Marshal(&transactions)
+    if err != nil {
+        utils.PrintErrorFull("readAssetTransactions - Marshal", err)
+        return nil, err
     }
-    return nil, nil // redundancy
+    utils.PrintSuccess("Retrieved the transactions of asset " + assetId)
+    return transactionsBytes, nil
 }
 
 
 // ============================================================================================================================
-